@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// Backend is where skydock registers services.  Every service is
+// identified by its uuid, see serviceUUID, and backends must follow
+// the skydns1 client's conventions:
+//
+//   - Add registers service under uuid and returns client.ErrConflictingUUID
+//     if the uuid is already registered, skydock then calls Update instead
+//   - Delete removes uuid and returns client.ErrServiceNotFound if it does
+//     not exist, which skydock treats as success
+//   - Update resets the TTL of uuid.  It is called every -beat seconds for
+//     each service and returns client.ErrServiceNotFound if the backend
+//     expired it, so skydock can Add it again.  Backends without TTLs
+//     return nil
+//   - List returns every service with its UUID set so reconciliation
+//     can remove records left behind while skydock was down
+//   - Close releases the backend's resources when skydock exits
+//
+// Backends are called concurrently from the event workers.
+type Backend interface {
+	Add(uuid string, service *msg.Service) error
+	Delete(uuid string) error
+	Update(uuid string, ttl uint32) error
+	List() ([]*msg.Service, error)
+	Close() error
+}
+
+// backendFactory creates a backend configured from params
+type backendFactory func() (Backend, error)
+
+var backendFactories = make(map[string]backendFactory)
+
+// registerBackend makes a backend available to -backend under name
+func registerBackend(name string, factory backendFactory) {
+	if _, exists := backendFactories[name]; exists {
+		panic(fmt.Sprintf("backend %s registered twice", name))
+	}
+	backendFactories[name] = factory
+}
+
+// newBackend creates the backend registered under name
+func newBackend(name string) (Backend, error) {
+	factory, exists := backendFactories[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown backend %q, choose one of %s", name, strings.Join(backendNames(), ", "))
+	}
+	return factory()
+}
+
+// volatileBackends keep nothing once skydock exits, services recorded
+// against them need no cleanup when they are dropped from -backend
+var volatileBackends = map[string]bool{"dns": true}
+
+// purgeDroppedBackends deletes the services the state file recorded against
+// backends that are no longer in -backend, nothing else would ever remove
+// them.  The dropped backends are created from their flags for the purge
+func purgeDroppedBackends() error {
+	dropped := registrations.droppedBackends()
+
+	names := make([]string, 0, len(dropped))
+	for name := range dropped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if volatileBackends[name] {
+			continue
+		}
+		log.Printf(log.INFO, "removing %d services from backend %s, it is no longer in -backend", len(dropped[name]), name)
+		b, err := newBackend(name)
+		if err != nil {
+			return fmt.Errorf("cannot remove services from dropped backend %s: %s", name, err)
+		}
+		for _, uuid := range dropped[name] {
+			if err := b.Delete(uuid); err != nil && err != client.ErrServiceNotFound {
+				b.Close()
+				return fmt.Errorf("cannot remove %s from dropped backend %s: %s", uuid, name, err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			log.Printf(log.ERROR, "error closing dropped backend %s: %s", name, err)
+		}
+	}
+
+	if len(dropped) > 0 {
+		registrations.moveBackends()
+	}
+	return nil
+}
+
+func backendNames() []string {
+	names := make([]string, 0, len(backendFactories))
+	for name := range backendFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ownerMarker starts the strings of a marker
+const ownerMarker = "skydock"
+
+// marker describes a service in backends that only store names and
+// addresses, such as a TXT record or a comment, so List can return it
+func marker(uuid string, service *msg.Service) []string {
+	return []string{
+		ownerMarker,
+		"uuid=" + uuid,
+		"service=" + service.Name,
+		"instance=" + service.Version,
+		"environment=" + service.Environment,
+		"region=" + service.Region,
+		"host=" + service.Host,
+		"port=" + strconv.Itoa(int(service.Port)),
+	}
+}
+
+// parseMarker returns the service described by marker, nil when the
+// strings are not a marker
+func parseMarker(txt []string) *msg.Service {
+	if len(txt) == 0 || txt[0] != ownerMarker {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	for _, field := range txt[1:] {
+		if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	if fields["uuid"] == "" {
+		return nil
+	}
+	port, _ := strconv.Atoi(fields["port"])
+
+	return &msg.Service{
+		UUID:        fields["uuid"],
+		Name:        fields["service"],
+		Version:     fields["instance"],
+		Environment: fields["environment"],
+		Region:      fields["region"],
+		Host:        fields["host"],
+		Port:        uint16(port),
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// tagsLabel lists extra consul tags for a container, comma separated
+const tagsLabel = "skydock.tags"
+
+func init() {
+	registerBackend("consul", newConsulBackend)
+}
+
+// consulService is a service registration of the consul agent API
+type consulService struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	Check   *consulCheck `json:",omitempty"`
+}
+
+type consulCheck struct {
+	TTL                            string
+	DeregisterCriticalServiceAfter string
+}
+
+// consulBackend registers every service with the local consul agent.  Each
+// registration has a TTL check that the heartbeat passes, so consul marks
+// a service critical when skydock stops refreshing it and removes it later
+type consulBackend struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newConsulBackend() (Backend, error) {
+	return newConsulClient(params.ConsulURL, params.ConsulToken), nil
+}
+
+func newConsulClient(url, token string) *consulBackend {
+	return &consulBackend{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Add registers the service under the uuid.  Registering is idempotent in
+// consul so an existing registration is replaced rather than reported as a
+// conflict
+func (c *consulBackend) Add(uuid string, service *msg.Service) error {
+	ttl := time.Duration(service.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = time.Duration(params.TTL) * time.Second
+	}
+	// consul refuses to deregister critical services sooner than a minute
+	deregister := 10 * ttl
+	if deregister < time.Minute {
+		deregister = time.Minute
+	}
+
+	name, tags := consulName(service)
+	registration := &consulService{
+		ID:      uuid,
+		Name:    name,
+		Address: service.Host,
+		Port:    int(service.Port),
+		Tags:    append(consulTags(uuid, service), tags...),
+		Meta: map[string]string{
+			"skydock":     "true",
+			"name":        service.Name,
+			"instance":    service.Version,
+			"environment": service.Environment,
+			"region":      service.Region,
+		},
+		Check: &consulCheck{
+			TTL:                            ttl.String(),
+			DeregisterCriticalServiceAfter: deregister.String(),
+		},
+	}
+
+	if _, err := c.do("PUT", "/v1/agent/service/register", registration); err != nil {
+		return err
+	}
+	// start passing right away instead of waiting for the first heartbeat
+	return c.Update(uuid, service.TTL)
+}
+
+func (c *consulBackend) Delete(uuid string) error {
+	_, err := c.do("PUT", "/v1/agent/service/deregister/"+url.PathEscape(uuid), nil)
+	return err
+}
+
+// Update passes the TTL check of uuid
+func (c *consulBackend) Update(uuid string, ttl uint32) error {
+	_, err := c.do("PUT", "/v1/agent/check/pass/"+url.PathEscape("service:"+uuid), nil)
+	return err
+}
+
+func (c *consulBackend) List() ([]*msg.Service, error) {
+	body, err := c.do("GET", "/v1/agent/services", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var services map[string]*consulService
+	if err := json.Unmarshal(body, &services); err != nil {
+		return nil, err
+	}
+
+	var out []*msg.Service
+	for _, service := range services {
+		if service.Meta["skydock"] != "true" {
+			continue
+		}
+		name := service.Meta["name"]
+		if name == "" {
+			name = service.Name
+		}
+		out = append(out, &msg.Service{
+			UUID:        service.ID,
+			Name:        name,
+			Version:     service.Meta["instance"],
+			Environment: service.Meta["environment"],
+			Region:      service.Meta["region"],
+			Host:        service.Address,
+			Port:        uint16(service.Port),
+		})
+	}
+	return out, nil
+}
+
+// Close does nothing, registrations stay with the agent until
+// their checks expire
+func (c *consulBackend) Close() error {
+	return nil
+}
+
+// do sends a request to the agent API.  Unknown services and checks are
+// reported as client.ErrServiceNotFound, older agents answer those with a
+// 500 rather than a 404
+func (c *consulBackend) do(method, path string, in interface{}) ([]byte, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.url+path, &body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(out))
+		if resp.StatusCode == http.StatusNotFound || strings.Contains(message, "Unknown service") || strings.Contains(message, "Unknown check") {
+			return nil, client.ErrServiceNotFound
+		}
+		return nil, fmt.Errorf("consul %s %s: %s: %s", method, path, resp.Status, message)
+	}
+	return out, nil
+}
+
+// consulName returns the consul service name of service.  Consul service
+// names are DNS labels, so the _name._protocol services registered for
+// every port go under the plain service name tagged with the port name and
+// _http._tcp.web is found as _web._http.service.consul
+func consulName(service *msg.Service) (string, []string) {
+	if !portService(service) {
+		return service.Name, nil
+	}
+	labels := strings.Split(service.Name, ".")
+	return strings.Join(labels[2:], "."), []string{strings.TrimPrefix(labels[0], "_")}
+}
+
+// consulTags returns the environment and instance of a service and the
+// tags in the skydock.tags label its container had when the services were
+// created
+func consulTags(uuid string, service *msg.Service) []string {
+	tags := []string{service.Environment, service.Version}
+	for _, tag := range strings.Split(registrations.label(containerUUID(uuid), tagsLabel), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
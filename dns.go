@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+func init() {
+	registerBackend("dns", newDNSBackend)
+}
+
+// newDNSBackend starts serving DNS on -dns from the registration table
+func newDNSBackend() (Backend, error) {
+	upstreams, err := nameservers(params.Nameservers)
+	if err != nil {
+		return nil, err
+	}
+
+	server := newDNSServer(params.Domain, upstreams, registrations)
+	log.Printf(log.INFO, "serving DNS for %s on %s, forwarding to %v", params.Domain, params.DNS, upstreams)
+	go func() {
+		if err := server.listen(params.DNS); err != nil {
+			log.Printf(log.FATAL, "error serving DNS: %s", err)
+			fatal(err)
+		}
+	}()
+	return &dnsBackend{server}, nil
+}
+
+// dnsServer answers queries for the domain from the registration table
+// and forwards everything else to the upstream nameservers
+type dnsServer struct {
+	domain    string
+	upstreams []string
+	table     *registrationTable
+
+	sync.Mutex
+	servers []*dns.Server
+	// address is the address listened on, served as ns.dns.<domain>
+	address net.IP
+}
+
+func newDNSServer(domain string, upstreams []string, table *registrationTable) *dnsServer {
+	return &dnsServer{
+		domain:    dns.Fqdn(strings.ToLower(domain)),
+		upstreams: upstreams,
+		table:     table,
+	}
+}
+
+// listen serves DNS on addr over both udp and tcp, it only returns on
+// error or after shutdown
+func (s *dnsServer) listen(addr string) error {
+	errs := make(chan error, 2)
+	s.Lock()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			s.address = ip
+		}
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: addr, Net: network, Handler: s}
+		s.servers = append(s.servers, server)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	s.Unlock()
+	return <-errs
+}
+
+func (s *dnsServer) shutdown() error {
+	s.Lock()
+	defer s.Unlock()
+
+	var err error
+	for _, server := range s.servers {
+		if e := server.Shutdown(); e != nil {
+			err = e
+		}
+	}
+	s.servers = nil
+	return err
+}
+
+func (s *dnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) == 0 {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(s.domain, name) {
+		s.forward(w, req)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = len(s.upstreams) > 0
+
+	if name == s.domain || name == s.nsName() {
+		s.serveZone(m, name, q.Qtype)
+		w.WriteMsg(m)
+		return
+	}
+
+	services := s.lookup(name)
+	if len(services) == 0 {
+		if name != "dns."+s.domain {
+			// dns.<domain> is above the nameserver so it exists
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = []dns.RR{s.soa()}
+		w.WriteMsg(m)
+		return
+	}
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		m.Answer = s.addresses(q.Name, q.Qtype, services)
+	case dns.TypeSRV:
+		m.Answer, m.Extra = s.srv(q.Name, services)
+	case dns.TypeANY:
+		m.Answer = append(s.addresses(q.Name, dns.TypeA, services), s.addresses(q.Name, dns.TypeAAAA, services)...)
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{s.soa()}
+	}
+	w.WriteMsg(m)
+}
+
+// serveZone answers for the apex, with its SOA and NS records, and for the
+// nameserver ns.dns.<domain> the NS record points at
+func (s *dnsServer) serveZone(m *dns.Msg, name string, qtype uint16) {
+	switch {
+	case name == s.domain:
+		if qtype == dns.TypeSOA || qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, s.soa())
+		}
+		if qtype == dns.TypeNS || qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, s.ns())
+			m.Extra = s.nsAddresses(dns.TypeA, dns.TypeAAAA)
+		}
+	case qtype == dns.TypeANY:
+		m.Answer = s.nsAddresses(dns.TypeA, dns.TypeAAAA)
+	default:
+		m.Answer = s.nsAddresses(qtype)
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{s.soa()}
+	}
+}
+
+func (s *dnsServer) nsName() string {
+	return "ns.dns." + s.domain
+}
+
+func (s *dnsServer) ns() dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: s.domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(params.TTL)},
+		Ns:  s.nsName(),
+	}
+}
+
+// nsAddresses returns the records of the listen address for the qtypes,
+// none when listening on every address
+func (s *dnsServer) nsAddresses(qtypes ...uint16) []dns.RR {
+	s.Lock()
+	address := s.address
+	s.Unlock()
+	if address == nil {
+		return nil
+	}
+
+	var out []dns.RR
+	for _, qtype := range qtypes {
+		if rr := addressRecord(s.nsName(), qtype, &msg.Service{Host: address.String()}); rr != nil {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// lookup returns the registered services matching name, see matches
+func (s *dnsServer) lookup(name string) []*msg.Service {
+	query := dns.SplitDomainName(strings.TrimSuffix(name, s.domain))
+
+	var out []*msg.Service
+	for _, records := range s.table.snapshot() {
+		for _, record := range records {
+			if record.Service != nil && matches(query, serviceLabels(record.Service)) {
+				out = append(out, record.Service)
+			}
+		}
+	}
+	return out
+}
+
+// serviceName returns the instance.service.environment name of a service,
+// without the domain
+func serviceName(service *msg.Service) string {
+	return strings.ToLower(strings.Join([]string{service.Version, service.Name, service.Environment}, "."))
+}
+
+func serviceLabels(service *msg.Service) []string {
+	return dns.SplitDomainName(serviceName(service))
+}
+
+// matches reports whether the query labels match the rightmost labels of
+// a service, so less specific queries return every instance below them.
+// A * label matches any single label
+func matches(query, labels []string) bool {
+	if len(query) == 0 || len(query) > len(labels) {
+		return false
+	}
+	labels = labels[len(labels)-len(query):]
+	for i, label := range query {
+		if label != "*" && label != labels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addresses returns one record per distinct host, the per port services of
+// a container share its address
+func (s *dnsServer) addresses(name string, qtype uint16, services []*msg.Service) []dns.RR {
+	var (
+		out  []dns.RR
+		seen = make(map[string]struct{})
+	)
+	for _, service := range services {
+		if _, exists := seen[service.Host]; exists {
+			continue
+		}
+		if rr := addressRecord(name, qtype, service); rr != nil {
+			seen[service.Host] = struct{}{}
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// addressRecord returns the A or AAAA record for the service host, nil
+// when the host is not an address of that type
+func addressRecord(name string, qtype uint16, service *msg.Service) dns.RR {
+	ip := net.ParseIP(service.Host)
+	if ip == nil {
+		return nil
+	}
+
+	header := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: serviceTTL(service)}
+	switch {
+	case qtype == dns.TypeA && ip.To4() != nil:
+		return &dns.A{Hdr: header, A: ip.To4()}
+	case qtype == dns.TypeAAAA && ip.To4() == nil:
+		return &dns.AAAA{Hdr: header, AAAA: ip}
+	}
+	return nil
+}
+
+// srv returns one SRV record per service pointing at the full name of the
+// instance, with the address of each target as extra records
+func (s *dnsServer) srv(name string, services []*msg.Service) (answer, extra []dns.RR) {
+	for _, service := range services {
+		target := serviceName(service) + "." + s.domain
+		answer = append(answer, &dns.SRV{
+			Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serviceTTL(service)},
+			Priority: 10,
+			Weight:   10,
+			Port:     service.Port,
+			Target:   target,
+		})
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if rr := addressRecord(target, qtype, service); rr != nil {
+				extra = append(extra, rr)
+			}
+		}
+	}
+	return answer, extra
+}
+
+// serviceRecords returns the records backends that write to a zone keep
+// for a service: A or AAAA, SRV and a TXT marker under the instance name
+// and A or AAAA and SRV under the service name, so that both
+// redis1.redis.dev.docker and redis.dev.docker resolve
+func serviceRecords(zone, uuid string, service *msg.Service) []dns.RR {
+	var (
+		instance = serviceName(service) + "." + zone
+		shared   = strings.ToLower(service.Name+"."+service.Environment) + "." + zone
+		ttl      = serviceTTL(service)
+		out      []dns.RR
+	)
+
+	for _, owner := range []string{instance, shared} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if rr := addressRecord(owner, qtype, service); rr != nil {
+				out = append(out, rr)
+			}
+		}
+		out = append(out, &dns.SRV{
+			Hdr:      dns.RR_Header{Name: owner, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+			Priority: 10,
+			Weight:   10,
+			Port:     service.Port,
+			Target:   instance,
+		})
+	}
+
+	return append(out, &dns.TXT{
+		Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: marker(uuid, service),
+	})
+}
+
+func (s *dnsServer) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(params.TTL)},
+		Ns:      s.nsName(),
+		Mbox:    "hostmaster." + s.domain,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 28800,
+		Retry:   7200,
+		Expire:  604800,
+		Minttl:  uint32(params.TTL),
+	}
+}
+
+// forward passes the query to each upstream in turn until one answers
+func (s *dnsServer) forward(w dns.ResponseWriter, req *dns.Msg) {
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+	c := &dns.Client{Net: network, Timeout: 2 * time.Second}
+
+	for _, upstream := range s.upstreams {
+		r, _, err := c.Exchange(req, upstream)
+		if err == nil {
+			w.WriteMsg(r)
+			return
+		}
+		log.Printf(log.WARN, "failed to forward %s to %s: %s", req.Question[0].Name, upstream, err)
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+func serviceTTL(service *msg.Service) uint32 {
+	if service.TTL > 0 {
+		return service.TTL
+	}
+	return uint32(params.TTL)
+}
+
+// nameservers returns the upstreams given with -nameserver or else the
+// nameservers from resolv.conf
+func nameservers(list string) ([]string, error) {
+	var out []string
+	if list != "" {
+		for _, ns := range strings.Split(list, ",") {
+			if _, _, err := net.SplitHostPort(ns); err != nil {
+				ns = net.JoinHostPort(ns, "53")
+			}
+			out = append(out, ns)
+		}
+		return out, nil
+	}
+
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("no -nameserver given and %s", err)
+	}
+	for _, ns := range config.Servers {
+		out = append(out, net.JoinHostPort(ns, config.Port))
+	}
+	return out, nil
+}
+
+// dnsBackend is used when skydock serves DNS itself.  The registration
+// table is the only store so there is nothing to send and nothing expires
+type dnsBackend struct {
+	server *dnsServer
+}
+
+func (b *dnsBackend) Add(uuid string, service *msg.Service) error { return nil }
+func (b *dnsBackend) Delete(uuid string) error                    { return nil }
+func (b *dnsBackend) Update(uuid string, ttl uint32) error        { return nil }
+
+func (b *dnsBackend) List() ([]*msg.Service, error) {
+	return b.server.table.services(), nil
+}
+
+func (b *dnsBackend) Close() error {
+	return b.server.shutdown()
+}
@@ -8,9 +8,10 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"os"
-	"os/signal"
-	"syscall"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/olitvin/skydock/slog"
 	"github.com/olitvin/skydock/utils"
@@ -21,18 +22,51 @@ type (
 		FetchAllContainers() ([]*Container, error)
 		FetchContainer(name, image string) (*Container, error)
 		GetEvents() chan *Event
+		// StopEvents closes the channel returned by GetEvents
+		StopEvents()
+		// Info describes the docker daemon
+		Info() (*Info, error)
 	}
 
+	// Info is the part of GET /info skydock uses.  ID identifies the
+	// daemon and stays the same across restarts of the daemon and of
+	// the containers talking to it
+	Info struct {
+		ID   string `json:"ID"`
+		Name string `json:"Name"`
+	}
+
+	// Event is a message from the events endpoint.  Docker 1.10 and newer
+	// send Type, Action and Actor, older daemons only send id, status and
+	// from; Normalize fills in whichever set is missing
 	Event struct {
 		ContainerId string `json:"id"`
 		Status      string `json:"status"`
 		Image       string `json:"from"`
+		Type        string `json:"Type"`
+		Action      string `json:"Action"`
+		Actor       Actor  `json:"Actor"`
+		Time        int64  `json:"time"`
+		TimeNano    int64  `json:"timeNano"`
+	}
+
+	// Actor is the object an event is about, for container events
+	// the ID is the container id and for network events it is the
+	// network id with the container in the attributes
+	Actor struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
 	}
 
 	ContainerConfig struct {
-		Hostname string   `json:"Hostname"`
-		Image    string   `json:"Image"`
-		Env      []string `json:"Env"`
+		Hostname string            `json:"Hostname"`
+		Image    string            `json:"Image"`
+		Env      []string          `json:"Env"`
+		Labels   map[string]string `json:"Labels"`
+	}
+
+	HostConfig struct {
+		NetworkMode string `json:"NetworkMode"`
 	}
 
 	Binding struct {
@@ -40,9 +74,39 @@ type (
 		HostPort string `json:"HostPort,omitempty"`
 	}
 
+	// EndpointSettings is the container's address on one network
+	EndpointSettings struct {
+		NetworkID           string   `json:"NetworkID"`
+		EndpointID          string   `json:"EndpointID"`
+		Aliases             []string `json:"Aliases"`
+		Gateway             string   `json:"Gateway"`
+		IPAddress           string   `json:"IPAddress"`
+		IPPrefixLen         int      `json:"IPPrefixLen"`
+		GlobalIPv6Address   string   `json:"GlobalIPv6Address"`
+		GlobalIPv6PrefixLen int      `json:"GlobalIPv6PrefixLen"`
+		MacAddress          string   `json:"MacAddress"`
+	}
+
 	NetworkSettings struct {
-		IpAddress string               `json:"IpAddress,omitempty"`
-		Ports     map[string][]Binding `json:"Ports,omitempty"`
+		IpAddress         string                       `json:"IpAddress,omitempty"`
+		GlobalIPv6Address string                       `json:"GlobalIPv6Address,omitempty"`
+		Ports             map[string][]Binding         `json:"Ports,omitempty"`
+		Networks          map[string]*EndpointSettings `json:"Networks,omitempty"`
+	}
+
+	HealthcheckResult struct {
+		Start    string `json:"Start"`
+		End      string `json:"End"`
+		ExitCode int    `json:"ExitCode"`
+		Output   string `json:"Output"`
+	}
+
+	// Health is only set for containers with a HEALTHCHECK, Status is
+	// one of HealthStarting, HealthHealthy or HealthUnhealthy
+	Health struct {
+		Status        string              `json:"Status"`
+		FailingStreak int                 `json:"FailingStreak"`
+		Log           []HealthcheckResult `json:"Log"`
 	}
 
 	// GET /containers/json returns the state of the container, one of:
@@ -53,36 +117,111 @@ type (
 	// - exitedor;
 	// - dead;
 	State struct {
-		Status     string `json:"Status"`
-		Running    bool   `json:"Running"`
-		Paused     bool   `json:"Paused"`
-		Restarting bool   `json:"Restarting"`
-		Dead       bool   `json:"Dead"`
-		Pid        uint64 `json:"Pid"`
-		ExitCode   uint32 `json:"ExitCode"`
-		Error      string `json:"Error"`
+		Status     string  `json:"Status"`
+		Running    bool    `json:"Running"`
+		Paused     bool    `json:"Paused"`
+		Restarting bool    `json:"Restarting"`
+		Dead       bool    `json:"Dead"`
+		Pid        uint64  `json:"Pid"`
+		ExitCode   uint32  `json:"ExitCode"`
+		Error      string  `json:"Error"`
+		StartedAt  string  `json:"StartedAt"`
+		Health     *Health `json:"Health"`
 	}
 
 	Container struct {
 		Id              string           `json:"Id"`
+		Created         string           `json:"Created"`
 		Image           string           `json:"Image"`
 		Name            string           `json:"Name"`
 		Config          *ContainerConfig `json:"Config"`
+		HostConfig      *HostConfig      `json:"HostConfig"`
 		NetworkSettings *NetworkSettings `json:"NetworkSettings"`
 		State           State            `json:"State"`
 	}
 
 	dockerClient struct {
 		path string
+
+		// MaxReplay is the longest outage of the events stream that is
+		// replayed with since=, the caller is asked to resync either way
+		MaxReplay  time.Duration
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+
+		stopLock sync.Mutex
+		stop     chan struct{}
 	}
 )
 
+const (
+	TypeContainer = "container"
+	TypeNetwork   = "network"
+
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+
+	// StatusResync is the status of the synthetic event sent on the events
+	// channel when events may have been lost and the caller should rebuild
+	// its state from FetchAllContainers
+	StatusResync = "resync"
+
+	defaultMaxReplay  = 5 * time.Minute
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
 var (
 	ErrImageNotTagged = errors.New("image not tagged")
 )
 
+// Normalize populates the legacy and the typed fields of the event from
+// each other so that handlers can rely on Type, Action and Actor
+func (e *Event) Normalize() {
+	if e.Action == "" {
+		e.Action = e.Status
+	}
+	if e.Status == "" {
+		e.Status = e.Action
+	}
+	if e.Type == "" && e.ContainerId != "" {
+		// only container events were sent before the Type field existed
+		e.Type = TypeContainer
+	}
+	if e.Actor.ID == "" {
+		e.Actor.ID = e.ContainerId
+	}
+	if e.Type == TypeContainer {
+		if e.ContainerId == "" {
+			e.ContainerId = e.Actor.ID
+		}
+		if e.Image == "" {
+			e.Image = e.Actor.Attributes["image"]
+		}
+	}
+	if e.TimeNano == 0 {
+		e.TimeNano = e.Time * int64(time.Second)
+	}
+}
+
+// HealthStatus returns the new status of a "health_status: healthy" style
+// container event or an empty string for other events
+func (e *Event) HealthStatus() string {
+	const prefix = "health_status:"
+	if e.Type != TypeContainer || !strings.HasPrefix(e.Action, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(e.Action[len(prefix):])
+}
+
 func NewClient(path string) (Docker, error) {
-	return &dockerClient{path}, nil
+	return &dockerClient{
+		path:       path,
+		MaxReplay:  defaultMaxReplay,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+	}, nil
 }
 
 func (d *dockerClient) newConn() (*httputil.ClientConn, error) {
@@ -126,6 +265,10 @@ func (d *dockerClient) FetchContainer(name, image string) (*Container, error) {
 			return nil, ErrImageNotTagged
 		}
 		container.Image = image
+		if image == "" && container.Config != nil {
+			// without an image from an event use the one the container was created with
+			container.Image = container.Config.Image
+		}
 
 		return container, nil
 	}
@@ -151,67 +294,241 @@ func (d *dockerClient) FetchAllContainers() ([]*Container, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK {
-		var containers []*Container
-		if err = json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		// the list endpoint returns a summary where State is a plain
+		// string so only decode the fields needed to fetch each container
+		var summaries []struct {
+			Id    string `json:"Id"`
+			Image string `json:"Image"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&summaries); err != nil {
 			return nil, err
 		}
+
+		containers := make([]*Container, len(summaries))
+		for i, s := range summaries {
+			containers[i] = &Container{Id: s.Id, Image: s.Image}
+		}
 		return containers, nil
 	}
 	return nil, fmt.Errorf("invalid HTTP request %d %s", resp.StatusCode, resp.Status)
 }
 
+func (d *dockerClient) Info() (*Info, error) {
+	req, err := http.NewRequest("GET", "/info", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.newConn()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid HTTP request %d %s", resp.StatusCode, resp.Status)
+	}
+	var info *Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// GetEvents streams docker events on the returned channel.  When the
+// connection to the events endpoint drops the client reconnects with
+// exponential backoff, resumes from the time of the last received event
+// unless the outage is longer than MaxReplay and sends a StatusResync
+// event.  The replay alone cannot be trusted, a restarted daemon or its
+// bounded event buffer may have lost events of any outage
 func (d *dockerClient) GetEvents() chan *Event {
 	eventChan := make(chan *Event, 100) // 100 event buffer
-	go func() {
-		defer close(eventChan)
 
-		c, err := d.newConn()
-		if err != nil {
-			log.Printf(log.FATAL, "cannot connect to docker: %s", err)
-			return
-		}
-		defer c.Close()
+	var (
+		current     *httputil.ClientConn
+		currentLock sync.Mutex
+		stopped     bool
+		stop        = make(chan struct{})
+	)
 
-		req, err := http.NewRequest("GET", "/events", nil)
-		if err != nil {
-			log.Printf(log.ERROR, "bad request for events: %s", err)
-			return
-		}
+	d.stopLock.Lock()
+	d.stop = stop
+	d.stopLock.Unlock()
 
-		resp, err := c.Do(req)
-		if err != nil {
-			log.Printf(log.FATAL, "cannot connect to events endpoint: %s", err)
-			return
+	// closing the connection ends the stream being read
+	go func() {
+		<-stop
+		currentLock.Lock()
+		stopped = true
+		if current != nil {
+			current.Close()
 		}
-		defer resp.Body.Close()
+		currentLock.Unlock()
+	}()
 
-		// handle signals to stop the socket
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-		go func() {
-			for sig := range sigChan {
-				log.Printf(log.INFO, "received signal '%v', exiting", sig)
+	go func() {
+		defer close(eventChan)
 
-				c.Close()
-				close(eventChan)
-				os.Exit(0)
-			}
-		}()
+		var (
+			last    int64
+			lost    time.Time
+			backoff = d.MinBackoff
+		)
 
-		dec := json.NewDecoder(resp.Body)
 		for {
-			var event *Event
-			if err := dec.Decode(&event); err != nil {
-				if err == io.EOF {
-					break
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			since := last
+			if !lost.IsZero() && time.Since(lost) > d.MaxReplay {
+				since = 0
+			}
+
+			c, resp, err := d.openEvents(since)
+			if err != nil {
+				log.Printf(log.ERROR, "cannot connect to events endpoint: %s", err)
+				select {
+				case <-time.After(backoff):
+				case <-stop:
+					return
+				}
+				if backoff *= 2; backoff > d.MaxBackoff {
+					backoff = d.MaxBackoff
 				}
-				log.Printf(log.ERROR, "cannot decode json: %s", err)
 				continue
 			}
+			backoff = d.MinBackoff
+
+			if !lost.IsZero() {
+				log.Printf(log.WARN, "events stream was down since %s, requesting resync", lost)
+				event := &Event{Status: StatusResync, TimeNano: time.Now().UnixNano()}
+				event.Normalize()
+				eventChan <- event
+			}
+			if since == 0 {
+				last = time.Now().UnixNano()
+			}
+
+			currentLock.Lock()
+			if stopped {
+				currentLock.Unlock()
+				resp.Body.Close()
+				c.Close()
+				return
+			}
+			current = c
+			currentLock.Unlock()
 
-			eventChan <- event
+			last = d.readEvents(resp.Body, eventChan, since, last)
+
+			currentLock.Lock()
+			current = nil
+			currentLock.Unlock()
+			resp.Body.Close()
+			c.Close()
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			lost = time.Now()
+			log.Printf(log.WARN, "events stream closed, reconnecting")
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return
+			}
 		}
-		log.Printf(log.DEBUG, "closing event channel")
 	}()
 	return eventChan
 }
+
+// StopEvents stops the stream started by GetEvents and closes its channel
+// once the events already read are delivered
+func (d *dockerClient) StopEvents() {
+	d.stopLock.Lock()
+	defer d.stopLock.Unlock()
+
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+}
+
+// openEvents connects to the events endpoint, replaying events newer
+// than since, in nanoseconds, when it is not zero.  Only container and
+// network events are requested
+func (d *dockerClient) openEvents(since int64) (*httputil.ClientConn, *http.Response, error) {
+	c, err := d.newConn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filters, err := json.Marshal(map[string][]string{
+		"type": {TypeContainer, TypeNetwork},
+	})
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	query := url.Values{}
+	query.Set("filters", string(filters))
+	if since > 0 {
+		query.Set("since", fmt.Sprintf("%d.%09d", since/int64(time.Second), since%int64(time.Second)))
+	}
+
+	req, err := http.NewRequest("GET", "/events?"+query.Encode(), nil)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		c.Close()
+		return nil, nil, fmt.Errorf("invalid HTTP request %d %s", resp.StatusCode, resp.Status)
+	}
+	return c, resp, nil
+}
+
+// readEvents decodes events from r until the stream ends and returns the
+// time of the last event seen in nanoseconds.  since is inclusive so
+// events at or before it were already delivered and are skipped
+func (d *dockerClient) readEvents(r io.Reader, eventChan chan *Event, since, last int64) int64 {
+	dec := json.NewDecoder(r)
+	for {
+		var event *Event
+		if err := dec.Decode(&event); err != nil {
+			if err != io.EOF {
+				log.Printf(log.ERROR, "cannot decode json: %s", err)
+			}
+			return last
+		}
+
+		event.Normalize()
+		if since > 0 && event.TimeNano <= since {
+			continue
+		}
+		if event.TimeNano > last {
+			last = event.TimeNano
+		}
+		eventChan <- event
+	}
+}
@@ -0,0 +1,303 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/olitvin/skydock/slog"
+)
+
+func init() {
+	log.Initialize()
+}
+
+func newTestServer(t *testing.T, handler http.HandlerFunc) (*dockerClient, func()) {
+	dir, err := ioutil.TempDir("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, handler)
+
+	client := &dockerClient{
+		path:       sock,
+		MaxReplay:  time.Minute,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+	return client, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func receive(t *testing.T, events chan *Event) *Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return nil
+}
+
+func TestGetEventsReconnectsWithSince(t *testing.T) {
+	var (
+		requests = make(chan string, 10)
+		base     = time.Now().Unix() + 100
+		count    int64
+	)
+
+	client, cleanup := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if filters := r.URL.Query().Get("filters"); filters != `{"type":["container","network"]}` {
+			t.Errorf("Unexpected filters %s", filters)
+		}
+		requests <- r.URL.Query().Get("since")
+		count++
+		// each connection delivers one event and then drops
+		fmt.Fprintf(w, `{"id":"%d","status":"start","from":"redis","time":%d}`, count, base+count)
+	})
+	defer cleanup()
+
+	events := client.GetEvents()
+
+	if event := receive(t, events); event.ContainerId != "1" {
+		t.Fatalf("Expected container 1 got %s", event.ContainerId)
+	}
+	// the replay may have missed events, the caller resyncs anyway
+	if event := receive(t, events); event.Status != StatusResync {
+		t.Fatalf("Expected status %s got %s", StatusResync, event.Status)
+	}
+	if event := receive(t, events); event.ContainerId != "2" {
+		t.Fatalf("Expected container 2 got %s", event.ContainerId)
+	}
+
+	if since := <-requests; since != "" {
+		t.Fatalf("Expected no since on first connect got %s", since)
+	}
+	if since, expected := <-requests, fmt.Sprintf("%d.000000000", base+1); since != expected {
+		t.Fatalf("Expected since %s got %s", expected, since)
+	}
+}
+
+func TestNormalizeLegacyEvent(t *testing.T) {
+	event := &Event{ContainerId: "1234", Status: "start", Image: "redis", Time: 10}
+	event.Normalize()
+
+	if event.Type != TypeContainer {
+		t.Fatalf("Expected type %s got %s", TypeContainer, event.Type)
+	}
+	if event.Action != "start" {
+		t.Fatalf("Expected action start got %s", event.Action)
+	}
+	if event.Actor.ID != "1234" {
+		t.Fatalf("Expected actor 1234 got %s", event.Actor.ID)
+	}
+	if event.TimeNano != 10*int64(time.Second) {
+		t.Fatalf("Expected time 10s got %d", event.TimeNano)
+	}
+}
+
+func TestNormalizeNetworkEvent(t *testing.T) {
+	event := &Event{
+		Type:   TypeNetwork,
+		Action: "connect",
+		Actor: Actor{
+			ID:         "net1",
+			Attributes: map[string]string{"container": "1234", "name": "backend"},
+		},
+	}
+	event.Normalize()
+
+	if event.ContainerId != "" {
+		t.Fatalf("Expected no container id got %s", event.ContainerId)
+	}
+	if event.Status != "connect" {
+		t.Fatalf("Expected status connect got %s", event.Status)
+	}
+}
+
+func TestNormalizeContainerEvent(t *testing.T) {
+	event := &Event{
+		Type:   TypeContainer,
+		Action: "die",
+		Actor: Actor{
+			ID:         "1234",
+			Attributes: map[string]string{"image": "olitvin/redis"},
+		},
+	}
+	event.Normalize()
+
+	if event.ContainerId != "1234" {
+		t.Fatalf("Expected container 1234 got %s", event.ContainerId)
+	}
+	if event.Image != "olitvin/redis" {
+		t.Fatalf("Expected image olitvin/redis got %s", event.Image)
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	event := &Event{Type: TypeContainer, Action: "health_status: healthy"}
+	if status := event.HealthStatus(); status != HealthHealthy {
+		t.Fatalf("Expected %s got %s", HealthHealthy, status)
+	}
+
+	event = &Event{Type: TypeContainer, Action: "start"}
+	if status := event.HealthStatus(); status != "" {
+		t.Fatalf("Expected no health status got %s", status)
+	}
+}
+
+func TestGetEventsRequestsResync(t *testing.T) {
+	var count int
+
+	client, cleanup := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count == 1 {
+			fmt.Fprintf(w, `{"id":"1","status":"start","from":"redis","time":1001}`)
+			return
+		}
+		// keep the second connection open
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	defer cleanup()
+
+	client.MaxReplay = 0
+	client.MinBackoff = 10 * time.Millisecond
+
+	events := client.GetEvents()
+
+	receive(t, events)
+	if event := receive(t, events); event.Status != StatusResync {
+		t.Fatalf("Expected status %s got %s", StatusResync, event.Status)
+	}
+}
+
+func TestGetEventsSkipsReplayedEvent(t *testing.T) {
+	var (
+		count int
+		base  = time.Now().Unix() + 100
+	)
+
+	client, cleanup := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count == 1 {
+			fmt.Fprintf(w, `{"id":"1","status":"start","from":"redis","time":%d}`, base+1)
+			return
+		}
+		// since is inclusive so the last event comes again
+		fmt.Fprintf(w, `{"id":"1","status":"start","from":"redis","time":%d}`, base+1)
+		fmt.Fprintf(w, `{"id":"2","status":"start","from":"redis","time":%d}`, base+2)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	defer cleanup()
+
+	events := client.GetEvents()
+	defer client.StopEvents()
+
+	receive(t, events)
+	if event := receive(t, events); event.Status != StatusResync {
+		t.Fatalf("Expected status %s got %s", StatusResync, event.Status)
+	}
+	if event := receive(t, events); event.ContainerId != "2" {
+		t.Fatalf("Expected the replayed event to be skipped got container %s", event.ContainerId)
+	}
+}
+
+func TestStopEvents(t *testing.T) {
+	client, cleanup := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"1","status":"start","from":"redis","time":1001}`)
+		// keep the connection open until the client closes it
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	defer cleanup()
+
+	events := client.GetEvents()
+	receive(t, events)
+
+	client.StopEvents()
+	select {
+	case _, open := <-events:
+		if open {
+			t.Fatal("Expected no events after stopping")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the events channel to be closed")
+	}
+}
+
+func TestFetchContainerDetails(t *testing.T) {
+	client, cleanup := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/web1/json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{
+			"Id": "1234567890abcdef",
+			"Created": "2016-01-01T00:00:00.000000000Z",
+			"Name": "/web1",
+			"Config": {"Image": "olitvin/web", "Labels": {"com.example.dns.service": "frontend"}},
+			"HostConfig": {"NetworkMode": "backend"},
+			"NetworkSettings": {
+				"IPAddress": "",
+				"Networks": {"backend": {"NetworkID": "n1", "IPAddress": "10.0.1.5", "IPPrefixLen": 24}}
+			},
+			"State": {"Status": "running", "Running": true, "Health": {"Status": "healthy", "FailingStreak": 0}}
+		}`)
+	})
+	defer cleanup()
+
+	container, err := client.FetchContainer("web1", "olitvin/web:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if container.Config.Labels["com.example.dns.service"] != "frontend" {
+		t.Fatalf("Expected label frontend got %v", container.Config.Labels)
+	}
+	if container.HostConfig.NetworkMode != "backend" {
+		t.Fatalf("Expected network mode backend got %s", container.HostConfig.NetworkMode)
+	}
+	if network := container.NetworkSettings.Networks["backend"]; network == nil || network.IPAddress != "10.0.1.5" {
+		t.Fatalf("Expected backend address 10.0.1.5 got %v", network)
+	}
+	if container.State.Health == nil || container.State.Health.Status != "healthy" {
+		t.Fatalf("Expected healthy container got %v", container.State.Health)
+	}
+	if container.Created != "2016-01-01T00:00:00.000000000Z" {
+		t.Fatalf("Expected created time got %s", container.Created)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	client, cleanup := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/info" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"ID": "7TRN:IPZB:QYBB:VPBQ:UWYS:DWLD:UBLV:7QUU:LYRM:JNRH:ZF3V:TPXZ", "Name": "docker1", "Containers": 3}`)
+	})
+	defer cleanup()
+
+	info, err := client.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "7TRN:IPZB:QYBB:VPBQ:UWYS:DWLD:UBLV:7QUU:LYRM:JNRH:ZF3V:TPXZ" || info.Name != "docker1" {
+		t.Fatalf("Unexpected info %v", info)
+	}
+}
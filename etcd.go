@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const etcdTimeout = 5 * time.Second
+
+func init() {
+	registerBackend("etcd", newEtcdBackend)
+}
+
+// etcdRecord is a SkyDNS2 service as read by CoreDNS's etcd plugin.  The
+// service skydock registered is kept alongside, CoreDNS ignores it
+type etcdRecord struct {
+	Host     string `json:"host"`
+	Port     uint16 `json:"port,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	TTL      uint32 `json:"ttl,omitempty"`
+
+	Skydock *msg.Service `json:"skydock,omitempty"`
+}
+
+// etcdBackend writes SkyDNS2 records for CoreDNS.  Every record is attached
+// to one lease that is kept alive while skydock runs, so records of a dead
+// skydock expire after -ttl seconds without any heartbeat
+type etcdBackend struct {
+	client *clientv3.Client
+	prefix string
+	domain string
+	ttl    int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sync.Mutex
+	lease clientv3.LeaseID
+	keys  map[string]string
+}
+
+func newEtcdBackend() (Backend, error) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(params.EtcdEndpoints, ","),
+		DialTimeout: etcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newEtcdClient(c, params.EtcdPrefix, params.Domain, int64(params.TTL)), nil
+}
+
+func newEtcdClient(c *clientv3.Client, prefix, domain string, ttl int64) *etcdBackend {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdBackend{
+		client: c,
+		prefix: strings.TrimSuffix(prefix, "/"),
+		domain: domain,
+		ttl:    ttl,
+		ctx:    ctx,
+		cancel: cancel,
+		keys:   make(map[string]string),
+	}
+}
+
+// etcdKey returns the reversed domain key of a service with the uuid as the
+// last label, redis1.redis.dev.docker is stored under
+// /skydns/docker/dev/redis/redis1/<uuid>.  CoreDNS serves every key below a
+// name as a record of that name, so containers on other hosts registering the
+// same name never share a key
+func etcdKey(prefix, domain, uuid string, service *msg.Service) string {
+	labels := strings.Split(serviceName(service)+"."+strings.ToLower(domain), ".")
+
+	path := []string{prefix}
+	for i := len(labels) - 1; i >= 0; i-- {
+		if labels[i] != "" {
+			path = append(path, labels[i])
+		}
+	}
+	return strings.Join(append(path, uuid), "/")
+}
+
+func (b *etcdBackend) Add(uuid string, service *msg.Service) error {
+	ctx, cancel := context.WithTimeout(b.ctx, etcdTimeout)
+	defer cancel()
+
+	lease, err := b.currentLease(ctx)
+	if err != nil {
+		return err
+	}
+
+	stored := *service
+	stored.UUID = uuid
+	value, err := json.Marshal(&etcdRecord{
+		Host:     service.Host,
+		Port:     service.Port,
+		Priority: 10,
+		TTL:      service.TTL,
+		Skydock:  &stored,
+	})
+	if err != nil {
+		return err
+	}
+
+	// only create the key, a record already there is this uuid's
+	key := etcdKey(b.prefix, b.domain, uuid, service)
+	resp, err := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value), clientv3.WithLease(lease))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	b.setKey(uuid, key)
+
+	if !resp.Succeeded {
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			if err := b.adopt(ctx, uuid, kvs[0], lease); err != nil {
+				return err
+			}
+		}
+		return client.ErrConflictingUUID
+	}
+	return nil
+}
+
+// Delete removes the record only if it is still the one of uuid at the
+// revision it was read, a record written meanwhile is left alone
+func (b *etcdBackend) Delete(uuid string) error {
+	ctx, cancel := context.WithTimeout(b.ctx, etcdTimeout)
+	defer cancel()
+
+	key, err := b.findKey(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	delete(b.keys, uuid)
+	b.Unlock()
+
+	kv, record, err := b.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if record == nil || record.Skydock == nil || record.Skydock.UUID != uuid {
+		return client.ErrServiceNotFound
+	}
+
+	resp, err := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return client.ErrServiceNotFound
+	}
+	return nil
+}
+
+// Update only checks that the record still exists and is attached to the
+// current lease, the lease keeps it alive.  A record lost with an expired
+// lease is reported as not found so skydock adds it again under a new lease
+func (b *etcdBackend) Update(uuid string, ttl uint32) error {
+	ctx, cancel := context.WithTimeout(b.ctx, etcdTimeout)
+	defer cancel()
+
+	key, err := b.findKey(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	kv, record, err := b.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if record == nil || record.Skydock == nil || record.Skydock.UUID != uuid {
+		return client.ErrServiceNotFound
+	}
+
+	lease, err := b.currentLease(ctx)
+	if err != nil {
+		return err
+	}
+	return b.adopt(ctx, uuid, kv, lease)
+}
+
+// adopt moves a record of this host written before skydock restarted to
+// lease, left on the lease of the previous skydock it would expire with it
+// although the container still runs
+func (b *etcdBackend) adopt(ctx context.Context, uuid string, kv *mvccpb.KeyValue, lease clientv3.LeaseID) error {
+	if clientv3.LeaseID(kv.Lease) == lease {
+		return nil
+	}
+
+	var record etcdRecord
+	if err := json.Unmarshal(kv.Value, &record); err != nil || record.Skydock == nil ||
+		record.Skydock.UUID != uuid || record.Skydock.Region != params.HostID {
+		// not ours to keep alive
+		return nil
+	}
+
+	key := string(kv.Key)
+	_, err := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+		Then(clientv3.OpPut(key, string(kv.Value), clientv3.WithLease(lease))).
+		Commit()
+	return err
+}
+
+func (b *etcdBackend) List() ([]*msg.Service, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, etcdTimeout)
+	defer cancel()
+
+	resp, err := b.client.Get(ctx, b.prefix+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*msg.Service
+	for _, kv := range resp.Kvs {
+		var record etcdRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil || record.Skydock == nil {
+			// not written by skydock
+			continue
+		}
+		out = append(out, record.Skydock)
+	}
+	return out, nil
+}
+
+// Close stops keeping the lease alive, the records expire after their TTL
+func (b *etcdBackend) Close() error {
+	b.cancel()
+	return b.client.Close()
+}
+
+func (b *etcdBackend) get(ctx context.Context, key string) (*mvccpb.KeyValue, *etcdRecord, error) {
+	resp, err := b.client.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil, nil
+	}
+
+	var record etcdRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &record); err != nil {
+		return nil, nil, err
+	}
+	return resp.Kvs[0], &record, nil
+}
+
+func (b *etcdBackend) setKey(uuid, key string) {
+	b.Lock()
+	b.keys[uuid] = key
+	b.Unlock()
+}
+
+// findKey returns the key of uuid, searching etcd for records written
+// before skydock was restarted
+func (b *etcdBackend) findKey(ctx context.Context, uuid string) (string, error) {
+	b.Lock()
+	key, exists := b.keys[uuid]
+	b.Unlock()
+	if exists {
+		return key, nil
+	}
+
+	resp, err := b.client.Get(ctx, b.prefix+"/", clientv3.WithPrefix())
+	if err != nil {
+		return "", err
+	}
+	for _, kv := range resp.Kvs {
+		var record etcdRecord
+		if err := json.Unmarshal(kv.Value, &record); err == nil && record.Skydock != nil && record.Skydock.UUID == uuid {
+			b.setKey(uuid, string(kv.Key))
+			return string(kv.Key), nil
+		}
+	}
+	return "", client.ErrServiceNotFound
+}
+
+// currentLease returns the lease records are attached to, granting a new
+// one when there is none or the last one expired
+func (b *etcdBackend) currentLease(ctx context.Context) (clientv3.LeaseID, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.lease != 0 {
+		return b.lease, nil
+	}
+
+	grant, err := b.client.Grant(ctx, b.ttl)
+	if err != nil {
+		return 0, err
+	}
+	responses, err := b.client.KeepAlive(b.ctx, grant.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	b.lease = grant.ID
+	go b.keepAlive(grant.ID, responses)
+	return grant.ID, nil
+}
+
+// keepAlive drains the keepalive responses of lease and forgets the lease
+// once etcd stops renewing it
+func (b *etcdBackend) keepAlive(lease clientv3.LeaseID, responses <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range responses {
+	}
+
+	b.Lock()
+	if b.lease == lease {
+		b.lease = 0
+	}
+	b.Unlock()
+
+	if b.ctx.Err() == nil {
+		log.Printf(log.WARN, "etcd lease %x expired, records will be added again under a new lease", lease)
+	}
+}
@@ -0,0 +1,178 @@
+//go:build etcd
+// +build etcd
+
+// These tests run against an embedded etcd server, run them with
+// go test -tags etcd
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func startEtcd(t *testing.T) (*clientv3.Client, func()) {
+	dir, err := ioutil.TempDir("", "skydock-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out starting etcd")
+	}
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{clientURL.String()}, DialTimeout: etcdTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEtcdBackend(t *testing.T) {
+	c, stop := startEtcd(t)
+	defer stop()
+
+	b := newEtcdClient(c, "/skydns", "docker", 30)
+	service := &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379, TTL: 30}
+
+	if err := b.Add("aaaaaaaaaa", service); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("aaaaaaaaaa", service); err != client.ErrConflictingUUID {
+		t.Fatalf("Expected a conflict adding the uuid again got %v", err)
+	}
+
+	// another skydock sharing the cluster registers the same name
+	other := newEtcdClient(c, "/skydns", "docker", 30)
+	if err := other.Add("bbbbbbbbbb", service); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	resp, err := c.Get(ctx, "/skydns/docker/dev/redis/redis1/aaaaaaaaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatal("Expected the record under /skydns/docker/dev/redis/redis1/aaaaaaaaaa")
+	}
+	if resp.Kvs[0].Lease == 0 {
+		t.Fatal("Expected the record to have a lease")
+	}
+
+	var record etcdRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Host != "172.17.0.4" || record.Port != 6379 {
+		t.Fatalf("Unexpected record %s", resp.Kvs[0].Value)
+	}
+
+	if err := b.Update("aaaaaaaaaa", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// an expired lease takes the record with it
+	if _, err := c.Revoke(ctx, resp.Kvs[0].Lease); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Update("aaaaaaaaaa", 30); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected the expired record to be not found got %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		b.Lock()
+		lease := b.lease
+		b.Unlock()
+		if lease == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := b.Add("aaaaaaaaaa", service); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new backend, as after a restart, finds the records through List
+	restarted := newEtcdClient(c, "/skydns", "docker", 30)
+	services, err := restarted.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("Expected both redis1 services got %v", services)
+	}
+
+	// the restarted skydock keeps its record alive under its own lease
+	if err := restarted.Update("aaaaaaaaaa", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Add("aaaaaaaaaa", service); err != client.ErrConflictingUUID {
+		t.Fatalf("Expected a conflict adding the uuid after a restart got %v", err)
+	}
+	b.Lock()
+	old := b.lease
+	b.Unlock()
+	if _, err := c.Revoke(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Update("aaaaaaaaaa", 30); err != nil {
+		t.Fatalf("Expected the record to survive the old lease got %v", err)
+	}
+
+	if err := restarted.Delete("aaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Delete("aaaaaaaaaa"); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected deleting twice to be not found got %v", err)
+	}
+
+	// the other skydock's record is left alone
+	if err := other.Update("bbbbbbbbbb", 30); err != nil {
+		t.Fatalf("Expected the other record to survive got %v", err)
+	}
+	other.cancel()
+
+	restarted.cancel()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// backendList is the value of the repeatable -backend flag
+type backendList []string
+
+func (l *backendList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *backendList) Set(name string) error {
+	*l = append(*l, name)
+	return nil
+}
+
+// newBackends creates the backends named with -backend behind an outbox
+// saved to path, more than one are combined into a fanout and each saves
+// its outbox to path followed by its name
+func newBackends(names []string, path string) (Backend, error) {
+	if len(names) == 1 {
+		b, err := newBackend(names[0])
+		if err != nil {
+			return nil, err
+		}
+		return newOutbox(names[0], b, path, false)
+	}
+
+	var members []*outbox
+	for _, name := range names {
+		b, err := newBackend(name)
+		if err != nil {
+			for _, m := range members {
+				m.Close()
+			}
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		memberPath := path
+		if path != "" {
+			memberPath = path + "." + name
+		}
+		m, err := newOutbox(name, b, memberPath, true)
+		if err != nil {
+			b.Close()
+			for _, m := range members {
+				m.Close()
+			}
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		members = append(members, m)
+	}
+	return &fanout{members: members}, nil
+}
+
+// fanout sends every operation to several backends.  Each backend has its
+// own async outbox so a slow or failing backend does not hold up the others
+type fanout struct {
+	members []*outbox
+}
+
+// Add queues the service on every backend, it never reports a conflict
+// because each backend resolves its own
+func (f *fanout) Add(uuid string, service *msg.Service) error {
+	return f.send(func(m *outbox) error { return m.Add(uuid, service) })
+}
+
+func (f *fanout) Delete(uuid string) error {
+	return f.send(func(m *outbox) error { return m.Delete(uuid) })
+}
+
+func (f *fanout) Update(uuid string, ttl uint32) error {
+	return f.send(func(m *outbox) error { return m.Update(uuid, ttl) })
+}
+
+// send queues an operation on every backend.  It only fails when every
+// backend is failing, as long as one takes the operation the others
+// catch up from their outboxes.  The outboxes keep it either way so the
+// error is a queuedError
+func (f *fanout) send(op func(m *outbox) error) error {
+	var errs []string
+	for _, m := range f.members {
+		if err := op(m); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) == len(f.members) {
+		return &queuedError{fmt.Errorf("every backend is failing: %s", strings.Join(errs, "; "))}
+	}
+	return nil
+}
+
+// List returns the services of every backend that answers, a service
+// registered differently in two backends is returned for each
+func (f *fanout) List() ([]*msg.Service, error) {
+	var (
+		out    []*msg.Service
+		failed int
+		err    error
+		seen   = make(map[string][]*msg.Service)
+	)
+	for _, m := range f.members {
+		services, e := m.backend.List()
+		if e != nil {
+			log.Printf(log.ERROR, "error listing services of backend %s: %s", m.name, e)
+			err = e
+			failed++
+			continue
+		}
+	next:
+		for _, service := range services {
+			for _, listed := range seen[service.UUID] {
+				if sameService(listed, service) {
+					continue next
+				}
+			}
+			seen[service.UUID] = append(seen[service.UUID], service)
+			out = append(out, service)
+		}
+	}
+	if failed == len(f.members) {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Close stops the outboxes and closes every backend
+func (f *fanout) Close() error {
+	var err error
+	for _, m := range f.members {
+		if e := m.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// stats returns the metrics of every backend
+func (f *fanout) stats() []backendStats {
+	out := make([]backendStats, len(f.members))
+	for i, m := range f.members {
+		out[i] = m.snapshot()
+	}
+	return out
+}
@@ -0,0 +1,10 @@
+module github.com/olitvin/skydock
+
+go 1.24.0
+
+require (
+	github.com/miekg/dns v1.1.72
+	github.com/robertkrimen/otto v0.2.1
+	go.etcd.io/etcd/api/v3 v3.6.8
+	go.etcd.io/etcd/client/v3 v3.6.8
+)
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+const hostsHeader = "# generated by skydock, changes will be overwritten\n"
+
+func init() {
+	registerBackend("hosts", newHostsBackend)
+}
+
+// hostsBackend keeps an /etc/hosts format file, for example a dnsmasq
+// addn-hosts file, with a line for every service that has an address.  The
+// file is rewritten on every change and the process -hostspid is sent a
+// SIGHUP so it reads it again
+type hostsBackend struct {
+	path   string
+	domain string
+	pid    int
+
+	sync.Mutex
+	services map[string]*msg.Service
+}
+
+func newHostsBackend() (Backend, error) {
+	return newHostsFile(params.HostsFile, params.Domain, params.HostsPid)
+}
+
+// newHostsFile creates a backend writing path, the services of an
+// existing file are kept so reconciliation can remove stale ones
+func newHostsFile(path, domain string, pid int) (*hostsBackend, error) {
+	b := &hostsBackend{
+		path:     path,
+		domain:   strings.ToLower(strings.TrimSuffix(domain, ".")),
+		pid:      pid,
+		services: make(map[string]*msg.Service),
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			if service := parseMarker(strings.Fields(line[i+1:])); service != nil {
+				b.services[service.UUID] = service
+			}
+		}
+	}
+	return b, nil
+}
+
+func (b *hostsBackend) Add(uuid string, service *msg.Service) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; exists {
+		return client.ErrConflictingUUID
+	}
+	b.services[uuid] = service
+	return b.write()
+}
+
+func (b *hostsBackend) Delete(uuid string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; !exists {
+		return client.ErrServiceNotFound
+	}
+	delete(b.services, uuid)
+	return b.write()
+}
+
+// Update does nothing, entries stay in the file until they are deleted
+func (b *hostsBackend) Update(uuid string, ttl uint32) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; !exists {
+		return client.ErrServiceNotFound
+	}
+	return nil
+}
+
+func (b *hostsBackend) List() ([]*msg.Service, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	out := make([]*msg.Service, 0, len(b.services))
+	for uuid, service := range b.services {
+		listed := *service
+		listed.UUID = uuid
+		out = append(out, &listed)
+	}
+	return out, nil
+}
+
+func (b *hostsBackend) Close() error {
+	return nil
+}
+
+// write replaces the file with the current services and signals -hostspid
+func (b *hostsBackend) write() error {
+	uuids := make([]string, 0, len(b.services))
+	for uuid := range b.services {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	var buf bytes.Buffer
+	buf.WriteString(hostsHeader)
+	written := make(map[string]map[string]bool)
+	for _, uuid := range uuids {
+		if line := b.line(uuid, b.services[uuid], written); line != "" {
+			buf.WriteString(line)
+		}
+	}
+
+	if err := writeFileAtomic(b.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	if b.pid > 0 {
+		if err := syscall.Kill(b.pid, syscall.SIGHUP); err != nil {
+			log.Printf(log.ERROR, "error sending SIGHUP to %d: %s", b.pid, err)
+		}
+	}
+	return nil
+}
+
+// line returns the hosts entry of a service under its full and short
+// names, services without an address and the _name._protocol services
+// registered for every port have none.  Names already in written for the
+// address are left out, the services of one container share the short name
+// and a service whose names are all taken is only kept as a comment
+func (b *hostsBackend) line(uuid string, service *msg.Service, written map[string]map[string]bool) string {
+	if net.ParseIP(service.Host) == nil || portService(service) {
+		return ""
+	}
+
+	names := written[service.Host]
+	if names == nil {
+		names = make(map[string]bool)
+		written[service.Host] = names
+	}
+
+	var fresh []string
+	for _, name := range []string{serviceName(service) + "." + b.domain, strings.ToLower(service.Version)} {
+		if !names[name] {
+			names[name] = true
+			fresh = append(fresh, name)
+		}
+	}
+
+	comment := strings.Join(marker(uuid, service), " ")
+	if len(fresh) == 0 {
+		return fmt.Sprintf("# %s\n", comment)
+	}
+	return fmt.Sprintf("%s\t%s\t# %s\n", service.Host, strings.Join(fresh, " "), comment)
+}
+
+// portService reports whether service is one of the _name._protocol
+// services createServices registers for every port of a container
+func portService(service *msg.Service) bool {
+	labels := strings.Split(service.Name, ".")
+	return len(labels) > 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_")
+}
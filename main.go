@@ -1,6 +1,5 @@
 /*
    Multihost
-   Multiple ports
 */
 
 package main
@@ -10,9 +9,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/olitvin/skydock/docker"
 	log "github.com/olitvin/skydock/slog"
 	"github.com/olitvin/skydock/utils"
@@ -31,16 +34,44 @@ type Params struct {
 	Beat                int
 	NumberOfHandlers    int
 	PluginFile          string
+	PluginTimeout       int
+	PluginRetries       int
+	PluginWatch         int
+	Reregister          bool
+	Resync              int
+	Network             string
+	PerNetwork          bool
+	HealthGate          bool
+	DNS                 string
+	Nameservers         string
+	Backends            backendList
+	EtcdEndpoints       string
+	EtcdPrefix          string
+	ConsulURL           string
+	ConsulToken         string
+	RFC2136Server       string
+	TSIGKey             string
+	TSIGAlgorithm       string
+	HostsFile           string
+	HostsPid            int
+	ZoneFile            string
+	ZoneNS              string
+	ZoneReload          string
+	Outbox              string
+	State               string
+	Metrics             string
+	HostID              string
 }
 
 var (
 	params Params
 
-	skydns       Skydns
+	backend      Backend
 	dockerClient docker.Docker
-	plugins      *pluginRuntime
-	running      = make(map[string]struct{})
-	runningLock  = sync.Mutex{}
+	plugins      servicePlugin
+
+	registrations = newRegistrationTable()
+	refresher     = newRefreshScheduler(refreshService)
 )
 
 func initParams() {
@@ -54,6 +85,33 @@ func initParams() {
 	flag.IntVar(&params.Beat, "beat", 0, "heartbeat interval")
 	flag.IntVar(&params.NumberOfHandlers, "workers", 3, "number of concurrent workers")
 	flag.StringVar(&params.PluginFile, "plugins", "/plugins/default.js", "file containing javascript plugins (plugins.js)")
+	flag.IntVar(&params.PluginTimeout, "plugintimeout", 1000, "milliseconds a plugin call may run before it is interrupted, 0 disables")
+	flag.IntVar(&params.PluginRetries, "pluginretries", 0, "number of times a failed plugin call is retried")
+	flag.IntVar(&params.PluginWatch, "pluginwatch", 5, "interval in seconds to check the plugins file for changes, 0 disables")
+	flag.BoolVar(&params.Reregister, "reregister", false, "register containers again when reloaded plugins change their services")
+	flag.IntVar(&params.Resync, "resync", 0, "interval in seconds to check running containers against registrations, 0 disables")
+	flag.StringVar(&params.Network, "network", "", "network whose address is registered, or first-nonbridge")
+	flag.BoolVar(&params.PerNetwork, "pernetwork", false, "also register one record per network as instance.service.network.environment")
+	flag.BoolVar(&params.HealthGate, "health", false, "register containers with a HEALTHCHECK only while they are healthy")
+	flag.StringVar(&params.DNS, "dns", "", "address to serve DNS for the domain on instead of using skydns, e.g. 172.17.42.1:53")
+	flag.StringVar(&params.Nameservers, "nameserver", "", "comma separated nameservers to forward other queries to with -dns, defaults to resolv.conf")
+	flag.Var(&params.Backends, "backend", "backend to register services with ("+strings.Join(backendNames(), ", ")+"), repeat to register with several, defaults to dns with -dns and skydns otherwise")
+	flag.StringVar(&params.EtcdEndpoints, "etcd", "http://127.0.0.1:2379", "comma separated etcd endpoints for the etcd backend")
+	flag.StringVar(&params.EtcdPrefix, "etcdprefix", "/skydns", "etcd path CoreDNS reads records from")
+	flag.StringVar(&params.ConsulURL, "consul", "http://127.0.0.1:8500", "url of the consul agent for the consul backend")
+	flag.StringVar(&params.ConsulToken, "consultoken", "", "consul ACL token")
+	flag.StringVar(&params.RFC2136Server, "rfc2136", "127.0.0.1:53", "address of the primary nameserver of the domain for the rfc2136 backend")
+	flag.StringVar(&params.TSIGKey, "tsig", "", "TSIG key to sign rfc2136 updates with as name:base64 secret")
+	flag.StringVar(&params.TSIGAlgorithm, "tsigalgorithm", dns.HmacSHA256, "TSIG algorithm")
+	flag.StringVar(&params.HostsFile, "hosts", "/etc/skydock/hosts", "hosts file written by the hosts backend, e.g. a dnsmasq addn-hosts file")
+	flag.IntVar(&params.HostsPid, "hostspid", 0, "pid to send SIGHUP to after the hosts file changes, e.g. dnsmasq")
+	flag.StringVar(&params.ZoneFile, "zonefile", "/etc/skydock/zone", "zone file written by the zone backend")
+	flag.StringVar(&params.ZoneNS, "zonens", "localhost.", "nameserver in the SOA and NS records of the zone file")
+	flag.StringVar(&params.ZoneReload, "zonereload", "", "command run after the zone file changes, e.g. rndc reload docker")
+	flag.StringVar(&params.State, "state", "", "file to keep the services skydock registered in so it knows which records it owns after a restart")
+	flag.StringVar(&params.Metrics, "metrics", "", "address to serve the metrics of every backend on as JSON at /debug/backends, e.g. 127.0.0.1:9100")
+	flag.StringVar(&params.Outbox, "outbox", "", "file to keep failed backend operations in so they are retried after a restart")
+	flag.StringVar(&params.HostID, "hostid", "", "identity of this docker host stamped as the region of its services, records of other hosts are never removed, defaults to the docker daemon id")
 	flag.Parse()
 
 	b, err := json.Marshal(params)
@@ -64,11 +122,43 @@ func initParams() {
 	log.Println(log.INFO, "Start with params: ", string(b))
 }
 
+// daemonHostID returns the id of the docker daemon as a single dns label.
+// Unlike the hostname of the skydock container it survives recreating or
+// upgrading skydock
+func daemonHostID(d docker.Docker) (string, error) {
+	info, err := d.Info()
+	if err != nil {
+		return "", err
+	}
+	if info.ID == "" {
+		return "", fmt.Errorf("docker did not report a daemon id")
+	}
+	return strings.ToLower(strings.Replace(info.ID, ":", "-", -1)), nil
+}
+
 func validateSettings() {
 	if params.Beat < 1 {
 		params.Beat = params.TTL - (params.TTL / 4)
 	}
 
+	if len(params.Backends) == 0 {
+		params.Backends = backendList{"skydns"}
+		if params.DNS != "" {
+			params.Backends = backendList{"dns"}
+		}
+	}
+
+	serveDNS := false
+	for _, name := range params.Backends {
+		serveDNS = serveDNS || name == "dns"
+	}
+	if serveDNS && params.DNS == "" {
+		fatal(fmt.Errorf("the dns backend needs the address to serve on with -dns"))
+	}
+	if !serveDNS && params.DNS != "" {
+		fatal(fmt.Errorf("-dns is only used by the dns backend, add -backend dns"))
+	}
+
 	if (params.SkydnsURL != "") && (params.SkydnsContainerName != "") {
 		fatal(fmt.Errorf("specify 'name' or 'skydns', not both"))
 	}
@@ -89,93 +179,150 @@ func setupLogger() error {
 	return nil
 }
 
-func heartbeat(uuid string) {
-	runningLock.Lock()
-	if _, exists := running[uuid]; exists {
-		runningLock.Unlock()
-		return
-	}
-	running[uuid] = struct{}{}
-	runningLock.Unlock()
-
-	defer func() {
-		runningLock.Lock()
-		delete(running, uuid)
-		runningLock.Unlock()
-	}()
-
-	var errorCount int
-	for _ = range time.Tick(time.Duration(params.Beat) * time.Second) {
-		if errorCount > 10 {
-			// if we encountered more than 10 errors just quit
-			log.Printf(log.ERROR, "aborting heartbeat for %s after 10 errors", uuid)
-			return
+// refreshService resets the TTL of uuid, adding the service again
+// if skydns already expired it
+func refreshService(uuid string) error {
+	err := updateService(uuid, params.TTL)
+	if err == client.ErrServiceNotFound {
+		if service, exists := registrations.service(uuid); exists {
+			log.Printf(log.WARN, "%s expired in skydns, adding it again", uuid)
+			return backend.Add(uuid, service)
 		}
+	}
+	return err
+}
 
-		// don't fill logs if we have a low params.Beat
-		// may need to do something better here
-		if params.Beat >= 30 {
-			log.Printf(log.INFO, "updating params.TTL for %s", uuid)
+// sendService sends the uuid and service data to skydns.  A service the
+// outbox queued for retry is refreshed like an added one and its error
+// is still returned
+func sendService(uuid string, service *msg.Service) error {
+	log.Println(log.INFO, fmt.Sprintf("adding %s (%s) to skydns", uuid, service.Name))
+	if err := backend.Add(uuid, service); err != nil {
+		if isQueued(err) {
+			log.Printf(log.WARN, "%s (%s) is queued until the backend takes it: %s", uuid, service.Name, err)
+			refresher.schedule(uuid)
+			return err
 		}
-
-		if err := updateService(uuid, params.TTL); err != nil {
-			errorCount++
-			log.Printf(log.ERROR, "%s", err)
-			break
+		// ignore erros for conflicting uuids and start the heartbeat again
+		if err != client.ErrConflictingUUID {
+			return err
 		}
+		log.Printf(log.INFO, "service already exists for %s. Resetting params.TTL.", uuid)
+		updateService(uuid, params.TTL)
 	}
+	log.Println(log.INFO, fmt.Sprintf("added %s (%s) successfully", uuid, service.Name))
+	refresher.schedule(uuid)
+	return nil
 }
 
-// restoreContainers loads all running containers and inserts
-// them into skydns when skydock starts
-func restoreContainers() error {
-	containers, err := dockerClient.FetchAllContainers()
-	if err != nil {
-		return err
+// sendServices registers every service of the container uuid under
+// its derived uuid and removes services the container no longer has.
+// Services the outbox queued are registered so they are refreshed and
+// removed like the others, the first queued error is returned
+func sendServices(uuid string, services []*msg.Service) error {
+	var (
+		err      error
+		queued   error
+		records  []registration
+		sent     = make(map[string]struct{})
+		old, _   = registrations.get(uuid)
+		previous = make(map[string]*msg.Service, len(old))
+	)
+
+	for _, record := range old {
+		previous[record.UUID] = record.Service
 	}
 
-	var container *docker.Container
-	for _, cnt := range containers {
-		uuid := utils.Truncate(cnt.Id)
-		if container, err = dockerClient.FetchContainer(uuid, cnt.Image); err != nil {
-			if err != docker.ErrImageNotTagged {
-				log.Printf(log.ERROR, "failed to fetch %s on restore: %s", cnt.Id, err)
+	for i, service := range services {
+		id := serviceUUID(uuid, i)
+		if record, exists := previous[id]; exists && !sameService(record, service) {
+			// skydns only resets the TTL of an existing uuid so the
+			// old record has to go before the new one is added
+			if err = backend.Delete(id); isQueued(err) {
+				// the add waits behind the delete in the outbox
+				if queued == nil {
+					queued = err
+				}
+				err = nil
+			} else if err != nil && err != client.ErrServiceNotFound {
+				break
 			}
-			continue
 		}
+		if err = sendService(id, service); isQueued(err) {
+			if queued == nil {
+				queued = err
+			}
+			err = nil
+		} else if err != nil {
+			break
+		}
+		records = append(records, registration{UUID: id, Service: service})
+		sent[id] = struct{}{}
+	}
 
-		service, err := plugins.createService(container)
+	for _, record := range old {
+		if _, exists := sent[record.UUID]; exists {
+			continue
+		}
 		if err != nil {
-			// doing a fatal here because we cannot do much if the plugins
-			// return an invalid service or error
-			fatal(err)
+			// keep what we could not replace
+			records = append(records, record)
+			continue
 		}
-		if err := sendService(uuid, service); err != nil {
-			log.Printf(log.ERROR, "failed to send %s to skydns on restore: %s", uuid, err)
+		refresher.cancel(record.UUID)
+		if err := backend.Delete(record.UUID); err != nil && err != client.ErrServiceNotFound && !isQueued(err) {
+			log.Printf(log.ERROR, "error removing %s from skydns: %s", record.UUID, err)
+			records = append(records, record)
 		}
 	}
-	return nil
-}
 
-// sendService sends the uuid and service data to skydns
-func sendService(uuid string, service *msg.Service) error {
-	log.Println(log.INFO, fmt.Sprintf("adding %s (%s) to skydns", uuid, service.Name))
-	if err := skydns.Add(uuid, service); err != nil {
-		// ignore erros for conflicting uuids and start the heartbeat again
-		if err != client.ErrConflictingUUID {
-			return err
-		}
-		log.Printf(log.INFO, "service already exists for %s. Resetting params.TTL.", uuid)
-		updateService(uuid, params.TTL)
+	if len(records) > 0 {
+		registrations.set(uuid, records)
+	} else {
+		registrations.remove(uuid)
 	}
-	log.Println(log.INFO, fmt.Sprintf("added %s (%s) successfully", uuid, service.Name))
-	go heartbeat(uuid)
-	return nil
+	if err == nil {
+		err = queued
+	}
+	return err
 }
 
+// removeService removes every service registered for the container uuid
 func removeService(uuid string) error {
 	log.Printf(log.INFO, "removing %s from skydns", uuid)
-	return skydns.Delete(uuid)
+
+	records, exists := registrations.get(uuid)
+	if !exists {
+		// not registered by us, but skydns may still have a record
+		records = []registration{{UUID: uuid}}
+	}
+
+	var (
+		err       error
+		queued    error
+		remaining []registration
+	)
+	for _, record := range records {
+		refresher.cancel(record.UUID)
+		switch e := backend.Delete(record.UUID); {
+		case isQueued(e):
+			// the outbox deletes it once the backend takes it
+			queued = e
+		case e != nil && e != client.ErrServiceNotFound:
+			err = e
+			remaining = append(remaining, record)
+		}
+	}
+
+	if err != nil {
+		// keep what is left so the next resync retries the delete
+		if exists {
+			registrations.set(uuid, remaining)
+		}
+		return err
+	}
+	registrations.remove(uuid)
+	return queued
 }
 
 func addService(uuid, image string) error {
@@ -188,21 +335,35 @@ func addService(uuid, image string) error {
 		return nil
 	}
 
-	service, err := plugins.createService(container)
+	if !shouldRegister(container) {
+		log.Printf(log.INFO, "not adding %s while it is paused or not healthy", uuid)
+		return nil
+	}
+
+	services, err := createServices(uuid, container)
 	if err != nil {
-		// doing a fatal here because we cannot do much if the plugins
-		// return an invalid service or error
-		fatal(err)
+		return err
 	}
 
-	if err := sendService(uuid, service); err != nil {
+	if err := sendServices(uuid, services); err != nil {
 		return err
 	}
 	return nil
 }
 
+// shouldRegister reports whether the container should be in skydns, paused
+// containers are not and with -health neither are containers whose
+// HEALTHCHECK does not report healthy
+func shouldRegister(container *docker.Container) bool {
+	if container.State.Paused {
+		return false
+	}
+	health := container.State.Health
+	return !params.HealthGate || health == nil || health.Status == docker.HealthHealthy
+}
+
 func updateService(uuid string, ttl int) error {
-	return skydns.Update(uuid, uint32(ttl))
+	return backend.Update(uuid, uint32(ttl))
 }
 
 func eventHandler(c chan *docker.Event, group *sync.WaitGroup) {
@@ -210,22 +371,207 @@ func eventHandler(c chan *docker.Event, group *sync.WaitGroup) {
 
 	for event := range c {
 		log.Printf(log.DEBUG, "received event (%s)", toJson(event))
-		uuid := utils.Truncate(event.ContainerId)
 
-		switch event.Status {
-		case "die", "stop", "kill":
-			if err := removeService(uuid); err != nil {
-				log.Printf(log.ERROR, fmt.Sprintf("error removing %s from skydns: %s", uuid, err))
+		if event.Action == docker.StatusResync {
+			// events may have been lost while the stream was down
+			// so reconcile skydns with what is running now
+			if _, err := reconcile(); err != nil {
+				log.Printf(log.ERROR, "error reconciling containers: %s", err)
 			}
-			log.Printf(log.ERROR, fmt.Sprintf("removed %s from skydns", uuid))
-		case "start", "restart":
-			if err := addService(uuid, event.Image); err != nil {
-				log.Printf(log.ERROR, fmt.Sprintf("error adding %s to skydns: %s", uuid, err))
+			continue
+		}
+
+		switch event.Type {
+		case docker.TypeContainer:
+			handleContainerEvent(event)
+		case docker.TypeNetwork:
+			handleNetworkEvent(event)
+		default:
+			log.Printf(log.DEBUG, "ignoring %s event %s", event.Type, event.Action)
+		}
+	}
+}
+
+// handleContainerEvent applies container lifecycle changes to skydns
+func handleContainerEvent(event *docker.Event) {
+	uuid := utils.Truncate(event.ContainerId)
+
+	switch event.Action {
+	case "die", "stop", "kill", "pause":
+		// a paused container cannot answer, it is unregistered until unpause
+		switch err := removeService(uuid); {
+		case err == nil:
+			log.Printf(log.INFO, "removed %s from skydns", uuid)
+		case isQueued(err):
+			log.Printf(log.WARN, "removing %s from skydns waits for a retry: %s", uuid, err)
+		default:
+			log.Printf(log.ERROR, fmt.Sprintf("error removing %s from skydns: %s", uuid, err))
+		}
+	case "start", "restart", "unpause":
+		if err := addService(uuid, event.Image); err != nil {
+			log.Printf(log.ERROR, fmt.Sprintf("error adding %s to skydns: %s", uuid, err))
+		}
+	case "rename":
+		// the instance name usually comes from the container name
+		if err := updateContainer(uuid); err != nil {
+			log.Printf(log.ERROR, fmt.Sprintf("error updating renamed %s: %s", uuid, err))
+		}
+	case "destroy":
+		if err := purgeContainer(uuid); err != nil {
+			log.Printf(log.ERROR, fmt.Sprintf("error cleaning up destroyed %s: %s", uuid, err))
+		}
+	case "oom":
+		// a die event follows if the container was killed
+		log.Printf(log.WARN, "container %s ran out of memory", uuid)
+	}
+
+	if !params.HealthGate {
+		return
+	}
+	switch event.HealthStatus() {
+	case docker.HealthHealthy:
+		if err := addService(uuid, event.Image); err != nil {
+			log.Printf(log.ERROR, fmt.Sprintf("error adding healthy %s to skydns: %s", uuid, err))
+		}
+	case docker.HealthUnhealthy:
+		if err := removeService(uuid); err != nil {
+			log.Printf(log.ERROR, fmt.Sprintf("error removing unhealthy %s from skydns: %s", uuid, err))
+		}
+	}
+}
+
+// purgeContainer removes every record of the container uuid, including
+// records skydock lost track of
+func purgeContainer(uuid string) error {
+	// removeService forgets the records, remember which were ours first
+	registered := make(map[string]struct{})
+	records, _ := registrations.get(uuid)
+	for _, record := range records {
+		registered[record.UUID] = struct{}{}
+	}
+
+	if err := removeService(uuid); err != nil && !isQueued(err) {
+		return err
+	}
+
+	listed, err := backend.List()
+	if err != nil {
+		return err
+	}
+	for _, record := range listed {
+		if record.UUID == uuid || containerUUID(record.UUID) != uuid {
+			continue
+		}
+		if _, exists := registered[record.UUID]; !exists && !registrations.owned(record) {
+			continue
+		}
+		log.Printf(log.INFO, "removing leftover %s of destroyed %s", record.UUID, uuid)
+		if err := backend.Delete(record.UUID); err != nil && err != client.ErrServiceNotFound && !isQueued(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleNetworkEvent updates the records of a registered container
+// when it is connected to or disconnected from a network
+func handleNetworkEvent(event *docker.Event) {
+	switch event.Action {
+	case "connect", "disconnect":
+		uuid := utils.Truncate(event.Actor.Attributes["container"])
+		if uuid == "" {
+			return
+		}
+		if err := updateContainer(uuid); err != nil {
+			log.Printf(log.ERROR, "error updating %s after network %s: %s", uuid, event.Action, err)
+		}
+	}
+}
+
+// updateContainer inspects a registered container again and updates its
+// records, services left without an address are removed
+func updateContainer(uuid string) error {
+	if _, exists := registrations.get(uuid); !exists {
+		return nil
+	}
+
+	container, err := dockerClient.FetchContainer(uuid, "")
+	if err != nil {
+		return err
+	}
+
+	services, err := createServices(uuid, container)
+	if err != nil {
+		return err
+	}
+
+	var addressed []*msg.Service
+	for _, service := range services {
+		if service.Host != "" {
+			addressed = append(addressed, service)
+		}
+	}
+
+	log.Printf(log.INFO, "updating %s with %d services", uuid, len(addressed))
+	if err := sendServices(uuid, addressed); err != nil {
+		return err
+	}
+	if len(addressed) == 0 {
+		// remember the container so connecting it to a network registers it again
+		registrations.set(uuid, nil)
+	}
+	return nil
+}
+
+// handleSignals runs a reconciliation pass and logs the metrics of
+// every backend on SIGUSR1, reloads the plugins on SIGHUP and stops the
+// events stream on SIGINT, SIGTERM and SIGQUIT so main can close the
+// backend.  A second stop signal exits right away
+func handleSignals() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+
+	stopping := false
+	for sig := range sigChan {
+		switch sig {
+		case os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT:
+			if stopping {
+				log.Printf(log.WARN, "received signal '%v' again, exiting now", sig)
+				os.Exit(1)
+			}
+			stopping = true
+			log.Printf(log.INFO, "received signal '%v', exiting", sig)
+			dockerClient.StopEvents()
+		case syscall.SIGUSR1:
+			log.Printf(log.INFO, "received SIGUSR1, reconciling containers")
+			if _, err := reconcile(); err != nil {
+				log.Printf(log.ERROR, "error reconciling containers: %s", err)
+			}
+			for _, stats := range backendMetrics() {
+				log.Printf(log.INFO, "%s", stats)
+			}
+			logRefreshQueue()
+		case syscall.SIGHUP:
+			log.Printf(log.INFO, "received SIGHUP, reloading plugins")
+			if err := reloadPlugins(); err != nil {
+				log.Printf(log.ERROR, "error reloading plugins: %s", err)
 			}
 		}
 	}
 }
 
+// logRefreshQueue logs how many services the heartbeat refreshes and
+// which one is due next
+func logRefreshQueue() {
+	scheduled := refresher.scheduled()
+	if len(scheduled) == 0 {
+		log.Printf(log.INFO, "no services scheduled for refresh")
+		return
+	}
+	next := scheduled[0]
+	log.Printf(log.INFO, "%d services scheduled for refresh, next %s in %s", len(scheduled), next.UUID, next.Next.Sub(time.Now()))
+}
+
 func fatal(err error) {
 	fmt.Fprintf(os.Stderr, "%s\n", err)
 	os.Exit(1)
@@ -244,7 +590,8 @@ func main() {
 		group = &sync.WaitGroup{}
 	)
 
-	plugins, err = newRuntime(params.PluginFile)
+	// one runtime per worker, otto is not safe for concurrent use
+	plugins, err = newPluginPool(params.PluginFile, params.NumberOfHandlers)
 	if err != nil {
 		fatal(err)
 	}
@@ -254,29 +601,59 @@ func main() {
 		fatal(err)
 	}
 
-	if params.SkydnsContainerName != "" {
-		log.Printf(log.INFO, "fetch skydns container: %s", params.SkydnsContainerName)
-		container, err := dockerClient.FetchContainer(params.SkydnsContainerName, "")
-		if err != nil {
-			log.Printf(log.FATAL, "error retrieving skydns container '%s': %s", params.SkydnsContainerName, err)
+	if params.HostID == "" {
+		if params.HostID, err = daemonHostID(dockerClient); err != nil {
+			log.Printf(log.FATAL, "error reading the docker daemon id, pass -hostid: %s", err)
 			fatal(err)
 		}
+		log.Printf(log.INFO, "using docker daemon id %s as -hostid", params.HostID)
+	}
 
-		params.SkydnsURL = "http://" + container.NetworkSettings.IpAddress + ":5380"
+	if params.State != "" {
+		if err := registrations.load(params.State); err != nil {
+			log.Printf(log.FATAL, "error loading state: %s", err)
+			fatal(err)
+		}
+		defer registrations.flush()
+		if err := purgeDroppedBackends(); err != nil {
+			log.Printf(log.FATAL, "%s, restore the -backend list or the flags of the dropped backend", err)
+			fatal(err)
+		}
 	}
 
-	if skydns, err = client.NewClient(params.SkydnsURL, params.Secret, params.Domain, "skydns"); err != nil {
-		log.Printf(log.FATAL, "error connecting to skydns: %s", err)
+	if backend, err = newBackends(params.Backends, params.Outbox); err != nil {
+		log.Printf(log.FATAL, "error creating backends %s: %s", params.Backends.String(), err)
 		fatal(err)
 	}
+	defer backend.Close()
+
+	refresher.interval = time.Duration(params.Beat) * time.Second
+	go refresher.run()
 
-	/*log.Printf(log.DEBUG, "starting restore of containers")
-	if err := restoreContainers(); err != nil {
-		log.Printf(log.FATAL, "error restoring containers: %s", err)
+	log.Printf(log.DEBUG, "starting reconciliation of containers")
+	if _, err := reconcile(); err != nil {
+		log.Printf(log.FATAL, "error reconciling containers: %s", err)
 		fatal(err)
-	}*/
+	}
+
+	if params.PluginWatch > 0 {
+		go watchPlugins(params.PluginFile, time.Duration(params.PluginWatch)*time.Second)
+	}
+
+	if params.Metrics != "" {
+		go func() {
+			if err := serveMetrics(params.Metrics); err != nil {
+				log.Printf(log.ERROR, "error serving metrics on %s: %s", params.Metrics, err)
+			}
+		}()
+	}
+
+	if params.Resync > 0 {
+		go resyncLoop(time.Duration(params.Resync) * time.Second)
+	}
 
 	events := dockerClient.GetEvents()
+	go handleSignals()
 
 	group.Add(params.NumberOfHandlers)
 	// Start event handlers
@@ -286,7 +663,7 @@ func main() {
 
 	log.Printf(log.DEBUG, "starting main process")
 	group.Wait()
-	log.Printf(log.DEBUG, "stopping cleanly via EOF")
+	log.Printf(log.INFO, "events stream stopped, closing the backend")
 }
 
 func toJson(input interface{}) string {
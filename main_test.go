@@ -1,16 +1,33 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/olitvin/skydock/docker"
 	"github.com/skynetservices/skydns1/client"
 	"github.com/skynetservices/skydns1/msg"
 )
 
+func init() {
+	setupLogger()
+}
+
 type mockSkydns struct {
 	services map[string]*msg.Service
 }
@@ -33,6 +50,20 @@ func (s *mockSkydns) Update(uuid string, ttl uint32) error {
 	return nil
 }
 
+func (s *mockSkydns) List() ([]*msg.Service, error) {
+	out := make([]*msg.Service, 0, len(s.services))
+	for uuid, service := range s.services {
+		record := *service
+		record.UUID = uuid
+		out = append(out, &record)
+	}
+	return out, nil
+}
+
+func (s *mockSkydns) Close() error {
+	return nil
+}
+
 func (s *mockSkydns) Delete(uuid string) error {
 	if _, exists := s.services[uuid]; !exists {
 		return client.ErrServiceNotFound
@@ -68,9 +99,25 @@ func (d *mockDocker) GetEvents() chan *docker.Event {
 	return nil
 }
 
+func (d *mockDocker) StopEvents() {}
+
+func (d *mockDocker) Info() (*docker.Info, error) {
+	return &docker.Info{ID: "7TRN:IPZB:QYBB:VPBQ:UWYS:DWLD:UBLV:7QUU:LYRM:JNRH:ZF3V:TPXZ", Name: "docker1"}, nil
+}
+
+func TestDaemonHostID(t *testing.T) {
+	id, err := daemonHostID(&mockDocker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "7trn-ipzb-qybb-vpbq-uwys-dwld-ublv-7quu-lyrm-jnrh-zf3v-tpxz" {
+		t.Fatalf("Unexpected host id %s", id)
+	}
+}
+
 func TestCreateService(t *testing.T) {
-	environment = "production"
-	ttl = 30
+	params.Environment = "production"
+	params.TTL = 30
 
 	p, err := newRuntime("plugins/default.js")
 	if err != nil {
@@ -86,10 +133,11 @@ func TestCreateService(t *testing.T) {
 		},
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createService(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 
 	if service.Version != "redis1" {
 		t.Fatalf("Expected version redis1 got %s", service.Version)
@@ -119,7 +167,7 @@ func TestAddService(t *testing.T) {
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	backend = &mockSkydns{make(map[string]*msg.Service)}
 	dockerClient = &mockDocker{
 		containers: map[string]*docker.Container{
 			"1": {
@@ -136,7 +184,7 @@ func TestAddService(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	service := skydns.(*mockSkydns).services["1"]
+	service := backend.(*mockSkydns).services["1"]
 
 	if service.Version != "redis1" {
 		t.Fatalf("Expected version redis1 got %s", service.Version)
@@ -166,7 +214,7 @@ func TestRemoveService(t *testing.T) {
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	backend = &mockSkydns{make(map[string]*msg.Service)}
 	dockerClient = &mockDocker{
 		containers: map[string]*docker.Container{
 			"1": {
@@ -183,7 +231,7 @@ func TestRemoveService(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	service := skydns.(*mockSkydns).services["1"]
+	service := backend.(*mockSkydns).services["1"]
 
 	if service == nil {
 		t.Fatalf("Service not properly added")
@@ -193,7 +241,7 @@ func TestRemoveService(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	service = skydns.(*mockSkydns).services["1"]
+	service = backend.(*mockSkydns).services["1"]
 
 	if service != nil {
 		t.Fatalf("Service not properly removed")
@@ -212,14 +260,14 @@ func TestEventHandler(t *testing.T) {
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	backend = &mockSkydns{make(map[string]*msg.Service)}
 	container := &docker.Container{
 		Image: "olitvin/redis:latest",
 		Name:  "redis1",
 		NetworkSettings: &docker.NetworkSettings{
 			IpAddress: "192.168.1.10",
 		},
-		State: docker.State("running"),
+		State: docker.State{Running: true},
 	}
 
 	dockerClient = &mockDocker{
@@ -232,6 +280,8 @@ func TestEventHandler(t *testing.T) {
 	go eventHandler(events, group)
 
 	events <- &docker.Event{
+		Type:        docker.TypeContainer,
+		Action:      "start",
 		Status:      "start",
 		Image:       "olitvin/redis",
 		ContainerId: "3",
@@ -240,7 +290,7 @@ func TestEventHandler(t *testing.T) {
 	close(events)
 	time.Sleep(3 * time.Second)
 
-	service := skydns.(*mockSkydns).services["3"]
+	service := backend.(*mockSkydns).services["3"]
 
 	if service == nil {
 		t.Fatal("No service added on event")
@@ -250,8 +300,8 @@ func TestEventHandler(t *testing.T) {
 }
 
 func TestEnvironmentPlugin(t *testing.T) {
-	environment = "production"
-	ttl = 30
+	params.Environment = "production"
+	params.TTL = 30
 
 	p, err := newRuntime("plugins/containerEnv.js")
 	if err != nil {
@@ -274,10 +324,11 @@ func TestEnvironmentPlugin(t *testing.T) {
 		},
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createService(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 
 	if service.Version != "test1" {
 		t.Fatalf("Expected version test1 got %s", service.Version)
@@ -307,7 +358,7 @@ func TestGetMappedPorts(t *testing.T) {
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	backend = &mockSkydns{make(map[string]*msg.Service)}
 	container := &docker.Container{
 		Image: "olitvin/redis:latest",
 		Name:  "redis1",
@@ -317,13 +368,14 @@ func TestGetMappedPorts(t *testing.T) {
 				"53/udp": {{HostIp: "192.168.0.1", HostPort: "53"}},
 			},
 		},
-		State: docker.State("running"),
+		State: docker.State{Running: true},
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createService(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 	if service.Port != 53 {
 		t.Fatalf("Expected port 53 got %d", service.Port)
 	}
@@ -336,7 +388,7 @@ func TestGetExposedPorts(t *testing.T) {
 	}
 	plugins = p
 
-	skydns = &mockSkydns{make(map[string]*msg.Service)}
+	backend = &mockSkydns{make(map[string]*msg.Service)}
 	container := &docker.Container{
 		Image: "olitvin/redis:latest",
 		Name:  "redis1",
@@ -346,14 +398,2084 @@ func TestGetExposedPorts(t *testing.T) {
 				"6379/udp": nil,
 			},
 		},
-		State: docker.State("running"),
+		State: docker.State{Running: true},
 	}
 
-	service, err := p.createService(container)
+	services, err := p.createService(container)
 	if err != nil {
 		t.Fatal(err)
 	}
+	service := services[0]
 	if service.Port != 6379 {
 		t.Fatalf("Expected port 6379 got %d", service.Port)
 	}
 }
+
+func TestReconcile(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	defer func(hostID string) { params.HostID = hostID }(params.HostID)
+	params.HostID = "host1"
+
+	registrations = newRegistrationTable()
+	backend = &mockSkydns{map[string]*msg.Service{
+		// still running with the same address
+		"aaaaaaaaaa": {Name: "redis", Version: "redis1", Environment: "production", Region: "host1", Host: "192.168.1.10", Port: 80, TTL: 5},
+		// container died while skydock was down
+		"bbbbbbbbbb": {Name: "redis", Version: "redis2", Environment: "production", Region: "host1", Host: "192.168.1.11", Port: 80},
+		// registered by skydock on another host sharing the backend
+		"dddddddddd": {Name: "redis", Version: "redis4", Environment: "production", Region: "host2", Host: "192.168.2.10", Port: 80},
+		// not registered by skydock
+		"manual": {Name: "db", Version: "db1", Environment: "production", Host: "192.168.1.50", Port: 5432},
+	}}
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"aaaaaaaaaa": {
+				Id:    "aaaaaaaaaa",
+				Image: "olitvin/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+				},
+			},
+			"cccccccccc": {
+				Id:    "cccccccccc",
+				Image: "olitvin/redis:latest",
+				Name:  "redis3",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.12",
+				},
+			},
+		},
+	}
+
+	summary, err := reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Added != 1 || summary.Updated != 1 || summary.Removed != 1 || summary.Failed != 0 {
+		t.Fatalf("Expected 1 added, 1 updated, 1 removed, 0 failed got %s", summary)
+	}
+
+	services := backend.(*mockSkydns).services
+	if services["aaaaaaaaaa"].TTL != uint32(params.TTL) {
+		t.Fatalf("Expected ttl %d got %d", params.TTL, services["aaaaaaaaaa"].TTL)
+	}
+	if _, exists := services["bbbbbbbbbb"]; exists {
+		t.Fatal("Expected dead container to be removed")
+	}
+	if services["cccccccccc"] == nil || services["cccccccccc"].Region != "host1" {
+		t.Fatalf("Expected running container to be added with the host id got %v", services["cccccccccc"])
+	}
+	if services["dddddddddd"] == nil {
+		t.Fatal("Expected record of another host to be kept")
+	}
+	if services["manual"] == nil {
+		t.Fatal("Expected record not owned by skydock to be kept")
+	}
+}
+
+func TestResync(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"aaaaaaaaaa": {
+				Id:    "aaaaaaaaaa",
+				Image: "olitvin/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+				},
+			},
+		},
+	}
+
+	// the container died but the event was missed
+	stale := &msg.Service{Name: "redis", Version: "redis2", Host: "192.168.1.11"}
+	backend.(*mockSkydns).services["bbbbbbbbbb"] = stale
+	registrations.set("bbbbbbbbbb", []registration{{UUID: "bbbbbbbbbb", Service: stale}})
+
+	summary, err := resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Added != 1 || summary.Removed != 1 {
+		t.Fatalf("Expected 1 added and 1 removed got %s", summary)
+	}
+	if _, exists := registrations.get("aaaaaaaaaa"); !exists {
+		t.Fatal("Expected running container to be registered")
+	}
+	if _, exists := registrations.get("bbbbbbbbbb"); exists {
+		t.Fatal("Expected dead container to be unregistered")
+	}
+	if _, exists := backend.(*mockSkydns).services["bbbbbbbbbb"]; exists {
+		t.Fatal("Expected dead container to be removed from skydns")
+	}
+
+	summary, err = resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Added+summary.Removed+summary.Failed != 0 {
+		t.Fatalf("Expected no corrections got %s", summary)
+	}
+}
+
+func TestRefreshScheduler(t *testing.T) {
+	var (
+		lock      sync.Mutex
+		refreshed = make(map[string]int)
+	)
+
+	s := newRefreshScheduler(func(uuid string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		refreshed[uuid]++
+		return nil
+	})
+	s.interval = 20 * time.Millisecond
+	go s.run()
+
+	s.schedule("1")
+	s.schedule("2")
+	s.schedule("2")
+
+	if entries := s.scheduled(); len(entries) != 2 {
+		t.Fatalf("Expected 2 scheduled entries got %d", len(entries))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	s.cancel("2")
+
+	lock.Lock()
+	cancelled := refreshed["2"]
+	lock.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if refreshed["1"] < 3 {
+		t.Fatalf("Expected at least 3 refreshes for 1 got %d", refreshed["1"])
+	}
+	if refreshed["2"] != cancelled {
+		t.Fatalf("Expected no refreshes for 2 after cancel got %d", refreshed["2"]-cancelled)
+	}
+	if entries := s.scheduled(); len(entries) != 1 || entries[0].UUID != "1" {
+		t.Fatalf("Expected only 1 to be scheduled got %v", entries)
+	}
+}
+
+func TestRefreshSchedulerBackoff(t *testing.T) {
+	s := newRefreshScheduler(func(uuid string) error {
+		return fmt.Errorf("skydns is down")
+	})
+	s.interval = time.Hour
+	s.schedule("1")
+
+	if due := s.due(); len(due) != 0 {
+		t.Fatalf("Expected nothing due got %d entries", len(due))
+	}
+
+	for i := 1; i <= 3; i++ {
+		s.queue[0].Next = time.Now()
+		for _, e := range s.due() {
+			s.refreshEntry(e)
+		}
+
+		entries := s.scheduled()
+		if entries[0].Failures != i {
+			t.Fatalf("Expected %d failures got %d", i, entries[0].Failures)
+		}
+		if wait := entries[0].Next.Sub(time.Now()); wait > minRefreshBackoff<<uint(i-1) {
+			t.Fatalf("Expected retry within %s got %s", minRefreshBackoff<<uint(i-1), wait)
+		}
+	}
+}
+
+func TestRefreshServiceAddsExpired(t *testing.T) {
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+	registrations.set("1", []registration{
+		{UUID: "1", Service: &msg.Service{Name: "redis", Version: "redis1", Host: "192.168.1.10"}},
+	})
+
+	if err := refreshService("1"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.(*mockSkydns).services["1"] == nil {
+		t.Fatal("Expected expired service to be added again")
+	}
+}
+
+func TestCreateServicePerPort(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := &docker.Container{
+		Image: "olitvin/web:latest",
+		Name:  "web1",
+		NetworkSettings: &docker.NetworkSettings{
+			IpAddress: "192.168.1.10",
+			Ports: map[string][]docker.Binding{
+				"443/tcp": nil,
+				"80/tcp":  {{HostIp: "0.0.0.0", HostPort: "8080"}},
+				"53/udp":  nil,
+			},
+		},
+	}
+
+	services, err := p.createService(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services) != 4 {
+		t.Fatalf("Expected 4 services got %d", len(services))
+	}
+
+	if services[0].Name != "web" {
+		t.Fatalf("Expected name web got %s", services[0].Name)
+	}
+
+	expected := []struct {
+		name string
+		port uint16
+	}{
+		{"_domain._udp.web", 53},
+		{"_https._tcp.web", 443},
+		{"_http._tcp.web", 8080},
+	}
+	for i, e := range expected {
+		if services[i+1].Name != e.name {
+			t.Fatalf("Expected name %s got %s", e.name, services[i+1].Name)
+		}
+		if services[i+1].Port != e.port {
+			t.Fatalf("Expected port %d got %d", e.port, services[i+1].Port)
+		}
+		if services[i+1].Version != "web1" {
+			t.Fatalf("Expected version web1 got %s", services[i+1].Version)
+		}
+	}
+}
+
+func TestAddServiceMultiplePorts(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {
+				Image: "olitvin/web:latest",
+				Name:  "web1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+					Ports: map[string][]docker.Binding{
+						"80/tcp":  nil,
+						"443/tcp": nil,
+					},
+				},
+			},
+		},
+	}
+
+	if err := addService("1", "olitvin/web"); err != nil {
+		t.Fatal(err)
+	}
+
+	services := backend.(*mockSkydns).services
+	if services["1"] == nil || services["1-1"] == nil || services["1-2"] == nil {
+		t.Fatalf("Expected services 1, 1-1 and 1-2 got %v", services)
+	}
+	if services["1-1"].Name != "_http._tcp.web" {
+		t.Fatalf("Expected name _http._tcp.web got %s", services["1-1"].Name)
+	}
+
+	if err := removeService("1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 0 {
+		t.Fatalf("Expected all services to be removed got %v", services)
+	}
+}
+
+func TestMultiServicePlugin(t *testing.T) {
+	p, err := newRuntime("plugins/multiService.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {
+				Image: "olitvin/app:latest",
+				Name:  "app1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+				},
+				Config: &docker.ContainerConfig{
+					Env: []string{"DNS_SERVICES=api:8080,metrics:9100"},
+				},
+			},
+		},
+	}
+
+	if err := addService("1", "olitvin/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	services := backend.(*mockSkydns).services
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services got %d", len(services))
+	}
+	if services["1"].Name != "api" || services["1"].Port != 8080 {
+		t.Fatalf("Expected api on 8080 got %s on %d", services["1"].Name, services["1"].Port)
+	}
+	if services["1-1"].Name != "metrics" || services["1-1"].Port != 9100 {
+		t.Fatalf("Expected metrics on 9100 got %s on %d", services["1-1"].Name, services["1-1"].Port)
+	}
+
+	if err := removeService("1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 0 {
+		t.Fatalf("Expected all services to be removed got %v", services)
+	}
+}
+
+func TestPluginPoolConcurrent(t *testing.T) {
+	p, err := newPluginPool("plugins/default.js", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		group  = &sync.WaitGroup{}
+		errors = make(chan error, 30)
+	)
+	for i := 0; i < 30; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+
+			container := &docker.Container{
+				Image: "olitvin/redis:latest",
+				Name:  fmt.Sprintf("redis%d", i),
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: fmt.Sprintf("192.168.1.%d", i),
+				},
+			}
+			services, err := p.createService(container)
+			if err != nil {
+				errors <- err
+				return
+			}
+			if services[0].Version != container.Name {
+				errors <- fmt.Errorf("Expected version %s got %s", container.Name, services[0].Version)
+			}
+		}(i)
+	}
+	group.Wait()
+	close(errors)
+
+	for err := range errors {
+		t.Fatal(err)
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	params.PluginTimeout = 50
+	defer func() {
+		params.PluginTimeout = 0
+	}()
+
+	runtime, err := loadRuntime(`function createService(container) { while (true) {} }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &pluginPool{runtimes: make(chan *pluginRuntime, 1)}
+	pool.runtimes <- runtime
+
+	container := &docker.Container{Name: "loop1", NetworkSettings: &docker.NetworkSettings{}}
+	if _, err := pool.createService(container); err != errPluginTimeout {
+		t.Fatalf("Expected timeout got %v", err)
+	}
+
+	if fresh := <-pool.runtimes; fresh == runtime {
+		t.Fatal("Expected broken runtime to be replaced")
+	}
+}
+
+func TestPluginExceptionIsContainerError(t *testing.T) {
+	runtime, err := loadRuntime(`function createService(container) { throw new Error("bad container"); }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = runtime
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"1": {Image: "olitvin/redis", Name: "redis1", NetworkSettings: &docker.NetworkSettings{}},
+		},
+	}
+
+	before := atomic.LoadUint64(&pluginFailures)
+	if err := addService("1", "olitvin/redis"); err == nil {
+		t.Fatal("Expected plugin error")
+	}
+	if atomic.LoadUint64(&pluginFailures) != before+1 {
+		t.Fatal("Expected plugin failure to be counted")
+	}
+	if len(backend.(*mockSkydns).services) != 0 {
+		t.Fatal("Expected nothing to be registered")
+	}
+}
+
+func TestReloadPlugins(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"aaaaaaaaaa": {
+				Id:    "aaaaaaaaaa",
+				Image: "olitvin/redis:latest",
+				Name:  "redis1",
+				NetworkSettings: &docker.NetworkSettings{
+					IpAddress: "192.168.1.10",
+				},
+			},
+		},
+	}
+	if err := addService("aaaaaaaaaa", "olitvin/redis"); err != nil {
+		t.Fatal(err)
+	}
+	// paused after it was registered
+	paused := &docker.Container{
+		Id:              "bbbbbbbbbb",
+		Image:           "olitvin/redis:latest",
+		Name:            "redis2",
+		NetworkSettings: &docker.NetworkSettings{IpAddress: "192.168.1.11"},
+	}
+	dockerClient.(*mockDocker).containers["bbbbbbbbbb"] = paused
+	if err := addService("bbbbbbbbbb", "olitvin/redis"); err != nil {
+		t.Fatal(err)
+	}
+	delete(backend.(*mockSkydns).services, "bbbbbbbbbb")
+	paused.State.Paused = true
+	// never registered
+	dockerClient.(*mockDocker).containers["cccccccccc"] = &docker.Container{
+		Id:              "cccccccccc",
+		Image:           "olitvin/redis:latest",
+		Name:            "redis3",
+		NetworkSettings: &docker.NetworkSettings{IpAddress: "192.168.1.12"},
+	}
+
+	file, err := ioutil.TempFile("", "skydock-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	params.PluginFile = file.Name()
+	params.Reregister = true
+	defer func() {
+		params.Reregister = false
+	}()
+
+	// a plugin that fails validation is not swapped in
+	ioutil.WriteFile(file.Name(), []byte(`function createService(container) { return 1; }`), 0644)
+	if err := reloadPlugins(); err == nil {
+		t.Fatal("Expected invalid plugins to be rejected")
+	}
+	if currentPlugins() != p {
+		t.Fatal("Expected old plugins to be kept")
+	}
+
+	ioutil.WriteFile(file.Name(), []byte(`function createService(container) {
+    return {
+        Port: 6379,
+        Environment: defaultEnvironment,
+        TTL: defaultTTL,
+        Service: "cache",
+        Instance: removeSlash(container.Name),
+        Host: container.NetworkSettings.IpAddress
+    };
+}`), 0644)
+	if err := reloadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+
+	service := backend.(*mockSkydns).services["aaaaaaaaaa"]
+	if service == nil || service.Name != "cache" {
+		t.Fatalf("Expected container to be registered again as cache got %v", service)
+	}
+	if len(backend.(*mockSkydns).services) != 1 {
+		t.Fatalf("Expected paused and unregistered containers to stay out got %v", backend.(*mockSkydns).services)
+	}
+}
+
+func TestPluginContainerDetails(t *testing.T) {
+	runtime, err := loadRuntime(`function createService(container) {
+    var l = labels(container);
+    var backend = container.NetworkSettings.Networks["backend"];
+    return {
+        Port: 80,
+        Environment: container.HostConfig.NetworkMode,
+        TTL: defaultTTL,
+        Service: l["com.example.dns.service"],
+        Instance: container.State.Health.Status,
+        Host: backend.IPAddress
+    };
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := &docker.Container{
+		Image: "olitvin/web:latest",
+		Name:  "web1",
+		Config: &docker.ContainerConfig{
+			Labels: map[string]string{"com.example.dns.service": "frontend"},
+		},
+		HostConfig: &docker.HostConfig{NetworkMode: "backend"},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]*docker.EndpointSettings{
+				"backend": {IPAddress: "10.0.1.5"},
+			},
+		},
+		State: docker.State{Running: true, Health: &docker.Health{Status: "healthy"}},
+	}
+
+	services, err := runtime.createService(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := services[0]
+	if service.Name != "frontend" {
+		t.Fatalf("Expected name frontend got %s", service.Name)
+	}
+	if service.Host != "10.0.1.5" {
+		t.Fatalf("Expected host 10.0.1.5 got %s", service.Host)
+	}
+	if service.Environment != "backend" {
+		t.Fatalf("Expected environment backend got %s", service.Environment)
+	}
+	if service.Version != "healthy" {
+		t.Fatalf("Expected version healthy got %s", service.Version)
+	}
+}
+
+func TestPluginLabelsWithoutConfig(t *testing.T) {
+	runtime, err := loadRuntime(`function createService(container) {
+    return {
+        Port: 80,
+        Environment: defaultEnvironment,
+        TTL: defaultTTL,
+        Service: labels(container)["missing"] || "none",
+        Instance: removeSlash(container.Name),
+        Host: container.NetworkSettings.IpAddress
+    };
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := runtime.createService(&docker.Container{Name: "web1", NetworkSettings: &docker.NetworkSettings{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if services[0].Name != "none" {
+		t.Fatalf("Expected name none got %s", services[0].Name)
+	}
+}
+
+func newNetworkedContainer() *docker.Container {
+	return &docker.Container{
+		Image: "olitvin/web:latest",
+		Name:  "web1",
+		Config: &docker.ContainerConfig{
+			Labels: map[string]string{},
+		},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]*docker.EndpointSettings{
+				"frontend": {IPAddress: "10.0.2.5"},
+				"backend":  {IPAddress: "10.0.1.5"},
+				"bridge":   {IPAddress: "172.17.0.5"},
+			},
+		},
+	}
+}
+
+func TestSelectAddress(t *testing.T) {
+	defer func() {
+		params.Network = ""
+	}()
+
+	tests := []struct {
+		network  string
+		label    string
+		expected string
+	}{
+		{"", "", "10.0.1.5"},
+		{"frontend", "", "10.0.2.5"},
+		{"frontend", "backend", "10.0.1.5"},
+		{"missing", "", "10.0.1.5"},
+		{networkNonBridge, "", "10.0.1.5"},
+	}
+
+	for _, test := range tests {
+		params.Network = test.network
+		container := newNetworkedContainer()
+		if test.label != "" {
+			container.Config.Labels[networkLabel] = test.label
+		}
+
+		if actual := selectAddress(container); actual != test.expected {
+			t.Fatalf("Expected %s for network %q label %q got %s", test.expected, test.network, test.label, actual)
+		}
+		if container.NetworkSettings.IpAddress != test.expected {
+			t.Fatalf("Expected IpAddress %s got %s", test.expected, container.NetworkSettings.IpAddress)
+		}
+	}
+
+	// the default bridge address is kept unless a network is chosen
+	params.Network = ""
+	container := newNetworkedContainer()
+	container.NetworkSettings.IpAddress = "172.17.0.5"
+	if actual := selectAddress(container); actual != "172.17.0.5" {
+		t.Fatalf("Expected 172.17.0.5 got %s", actual)
+	}
+	params.Network = networkNonBridge
+	if actual := selectAddress(container); actual != "10.0.1.5" {
+		t.Fatalf("Expected 10.0.1.5 got %s", actual)
+	}
+}
+
+func TestPerNetworkServices(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params.PerNetwork = true
+	defer func() {
+		params.PerNetwork = false
+	}()
+
+	services, err := buildServices(p, newNetworkedContainer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services) != 4 {
+		t.Fatalf("Expected 4 services got %d", len(services))
+	}
+	if services[0].Host != "10.0.1.5" || services[0].Environment != params.Environment {
+		t.Fatalf("Expected 10.0.1.5 in %s got %s in %s", params.Environment, services[0].Host, services[0].Environment)
+	}
+
+	expected := map[string]string{
+		"backend." + params.Environment:  "10.0.1.5",
+		"bridge." + params.Environment:   "172.17.0.5",
+		"frontend." + params.Environment: "10.0.2.5",
+	}
+	for _, service := range services[1:] {
+		if expected[service.Environment] != service.Host {
+			t.Fatalf("Unexpected host %s for %s", service.Host, service.Environment)
+		}
+	}
+}
+
+func TestNetworkEvents(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+
+	container := &docker.Container{
+		Image: "olitvin/redis:latest",
+		Name:  "redis1",
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]*docker.EndpointSettings{
+				"backend": {IPAddress: "10.0.1.5"},
+			},
+		},
+	}
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{"aaaaaaaaaa": container},
+	}
+
+	if err := addService("aaaaaaaaaa", "olitvin/redis"); err != nil {
+		t.Fatal(err)
+	}
+
+	// moved from backend to frontend
+	container.NetworkSettings = &docker.NetworkSettings{
+		Networks: map[string]*docker.EndpointSettings{
+			"frontend": {IPAddress: "10.0.2.5"},
+		},
+	}
+	handleNetworkEvent(&docker.Event{
+		Type:   docker.TypeNetwork,
+		Action: "connect",
+		Actor:  docker.Actor{ID: "net1", Attributes: map[string]string{"container": "aaaaaaaaaabbbbbb", "name": "frontend"}},
+	})
+
+	service := backend.(*mockSkydns).services["aaaaaaaaaa"]
+	if service == nil || service.Host != "10.0.2.5" {
+		t.Fatalf("Expected host 10.0.2.5 after connect got %v", service)
+	}
+
+	// disconnected from every network
+	container.NetworkSettings = &docker.NetworkSettings{}
+	handleNetworkEvent(&docker.Event{
+		Type:   docker.TypeNetwork,
+		Action: "disconnect",
+		Actor:  docker.Actor{ID: "net1", Attributes: map[string]string{"container": "aaaaaaaaaabbbbbb", "name": "frontend"}},
+	})
+
+	if _, exists := backend.(*mockSkydns).services["aaaaaaaaaa"]; exists {
+		t.Fatal("Expected service to be removed after disconnect")
+	}
+	if records, _ := registrations.get("aaaaaaaaaa"); len(records) != 0 {
+		t.Fatalf("Expected no registered services after disconnect got %d", len(records))
+	}
+
+	// and registered again once it is connected
+	container.NetworkSettings = &docker.NetworkSettings{
+		Networks: map[string]*docker.EndpointSettings{
+			"backend": {IPAddress: "10.0.1.6"},
+		},
+	}
+	handleNetworkEvent(&docker.Event{
+		Type:   docker.TypeNetwork,
+		Action: "connect",
+		Actor:  docker.Actor{ID: "net2", Attributes: map[string]string{"container": "aaaaaaaaaabbbbbb", "name": "backend"}},
+	})
+	if service := backend.(*mockSkydns).services["aaaaaaaaaa"]; service == nil || service.Host != "10.0.1.6" {
+		t.Fatalf("Expected host 10.0.1.6 after reconnect got %v", service)
+	}
+	if err := removeService("aaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+
+	// containers we did not register are ignored
+	handleNetworkEvent(&docker.Event{
+		Type:   docker.TypeNetwork,
+		Action: "connect",
+		Actor:  docker.Actor{ID: "net1", Attributes: map[string]string{"container": "cccccccccc"}},
+	})
+	if len(backend.(*mockSkydns).services) != 0 {
+		t.Fatal("Expected unregistered container to be ignored")
+	}
+}
+
+func TestHealthGate(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	params.HealthGate = true
+	defer func() {
+		params.HealthGate = false
+	}()
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+
+	checked := &docker.Container{
+		Image:           "olitvin/web:latest",
+		Name:            "web1",
+		NetworkSettings: &docker.NetworkSettings{IpAddress: "192.168.1.10"},
+		State:           docker.State{Running: true, Health: &docker.Health{Status: docker.HealthStarting}},
+	}
+	unchecked := &docker.Container{
+		Image:           "olitvin/redis:latest",
+		Name:            "redis1",
+		NetworkSettings: &docker.NetworkSettings{IpAddress: "192.168.1.11"},
+		State:           docker.State{Running: true},
+	}
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{"1": checked, "2": unchecked},
+	}
+
+	event := func(id, action string) *docker.Event {
+		return &docker.Event{Type: docker.TypeContainer, Action: action, ContainerId: id}
+	}
+	services := backend.(*mockSkydns).services
+
+	handleContainerEvent(event("1", "start"))
+	handleContainerEvent(event("2", "start"))
+	if services["1"] != nil {
+		t.Fatal("Expected container with a healthcheck to wait until healthy")
+	}
+	if services["2"] == nil {
+		t.Fatal("Expected container without a healthcheck to be added on start")
+	}
+
+	checked.State.Health.Status = docker.HealthHealthy
+	handleContainerEvent(event("1", "health_status: healthy"))
+	if services["1"] == nil {
+		t.Fatal("Expected container to be added once healthy")
+	}
+
+	checked.State.Health.Status = docker.HealthUnhealthy
+	handleContainerEvent(event("1", "health_status: unhealthy"))
+	if services["1"] != nil {
+		t.Fatal("Expected container to be removed when unhealthy")
+	}
+}
+
+func TestPauseRenameDestroyEvents(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	defer func(hostID string) { params.HostID = hostID }(params.HostID)
+	params.HostID = "host1"
+
+	backend = &mockSkydns{make(map[string]*msg.Service)}
+	registrations = newRegistrationTable()
+
+	container := &docker.Container{
+		Id:              "aaaaaaaaaa",
+		Image:           "olitvin/redis:latest",
+		Name:            "/redis1",
+		NetworkSettings: &docker.NetworkSettings{IpAddress: "192.168.1.10"},
+		State:           docker.State{Running: true},
+	}
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{"aaaaaaaaaa": container},
+	}
+
+	event := func(action string) *docker.Event {
+		return &docker.Event{Type: docker.TypeContainer, Action: action, ContainerId: "aaaaaaaaaa", Image: "olitvin/redis"}
+	}
+	services := backend.(*mockSkydns).services
+
+	handleContainerEvent(event("start"))
+
+	container.State.Paused = true
+	handleContainerEvent(event("pause"))
+	if services["aaaaaaaaaa"] != nil {
+		t.Fatal("Expected paused container to be removed")
+	}
+	if summary, _ := resync(); summary.Added != 0 || services["aaaaaaaaaa"] != nil {
+		t.Fatal("Expected resync to leave the paused container alone")
+	}
+
+	container.State.Paused = false
+	handleContainerEvent(event("unpause"))
+	if services["aaaaaaaaaa"] == nil {
+		t.Fatal("Expected unpaused container to be added")
+	}
+
+	container.Name = "/cache1"
+	handleContainerEvent(event("rename"))
+	if service := services["aaaaaaaaaa"]; service == nil || service.Version != "cache1" {
+		t.Fatalf("Expected renamed instance cache1 got %v", service)
+	}
+
+	// a record skydock lost track of
+	services["aaaaaaaaaa-3"] = &msg.Service{Name: "redis", Version: "redis1", Region: "host1"}
+	handleContainerEvent(event("destroy"))
+	if len(services) != 0 {
+		t.Fatalf("Expected destroy to remove every record got %v", services)
+	}
+}
+
+// startDNS serves handler on a random local udp port and returns its address
+func startDNS(t *testing.T, handler dns.Handler) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	r, err := dns.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDNSServer(t *testing.T) {
+	params.TTL = 30
+
+	upstream, stopUpstream := startDNS(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("93.184.216.34"),
+		}}
+		w.WriteMsg(m)
+	}))
+	defer stopUpstream()
+
+	table := newRegistrationTable()
+	table.set("aaaaaaaaaa", []registration{
+		{UUID: "aaaaaaaaaa", Service: &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}},
+		{UUID: "aaaaaaaaaa-1", Service: &msg.Service{Name: "_redis._tcp.redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}},
+	})
+	table.set("bbbbbbbbbb", []registration{
+		{UUID: "bbbbbbbbbb", Service: &msg.Service{Name: "redis", Version: "redis2", Environment: "dev", Host: "fd00::5", Port: 6379}},
+	})
+
+	addr, stop := startDNS(t, newDNSServer("docker", []string{upstream}, table))
+	defer stop()
+
+	if r := query(t, addr, "redis.dev.docker", dns.TypeA); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "172.17.0.4" {
+		t.Fatalf("Expected one A record for 172.17.0.4 got %v", r.Answer)
+	}
+	if r := query(t, addr, "redis2.redis.dev.docker", dns.TypeAAAA); len(r.Answer) != 1 || r.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::5" {
+		t.Fatalf("Expected one AAAA record for fd00::5 got %v", r.Answer)
+	}
+	if r := query(t, addr, "redis.*.docker", dns.TypeA); len(r.Answer) != 1 || !r.Authoritative {
+		t.Fatalf("Expected an authoritative wildcard answer got %v", r)
+	}
+
+	r := query(t, addr, "_redis._tcp.redis.dev.docker", dns.TypeSRV)
+	if len(r.Answer) != 1 {
+		t.Fatalf("Expected one SRV record got %v", r.Answer)
+	}
+	if srv := r.Answer[0].(*dns.SRV); srv.Port != 6379 || srv.Target != "redis1._redis._tcp.redis.dev.docker." {
+		t.Fatalf("Unexpected SRV record %v", srv)
+	}
+	if len(r.Extra) != 1 {
+		t.Fatalf("Expected the target address as extra got %v", r.Extra)
+	}
+
+	if r := query(t, addr, "postgres.dev.docker", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	// the apex exists even though no service is named after it
+	for _, qtype := range []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeA} {
+		r := query(t, addr, "docker", qtype)
+		if r.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Expected NOERROR for the apex %s got %s", dns.TypeToString[qtype], dns.RcodeToString[r.Rcode])
+		}
+		if qtype == dns.TypeA && (len(r.Answer) != 0 || len(r.Ns) != 1) {
+			t.Fatalf("Expected no data and the SOA for the apex A got %v", r)
+		}
+		if qtype != dns.TypeA && (len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != qtype) {
+			t.Fatalf("Expected the apex %s got %v", dns.TypeToString[qtype], r.Answer)
+		}
+	}
+	if r := query(t, addr, "docker", dns.TypeNS); r.Answer[0].(*dns.NS).Ns != "ns.dns.docker." {
+		t.Fatalf("Expected ns.dns.docker as nameserver got %v", r.Answer)
+	}
+	if r := query(t, addr, "dns.docker", dns.TypeA); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected NOERROR above the nameserver got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	if r := query(t, addr, "example.com", dns.TypeA); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Fatalf("Expected the forwarded answer got %v", r.Answer)
+	}
+}
+
+func TestNewBackend(t *testing.T) {
+	if _, err := newBackend("nope"); err == nil {
+		t.Fatal("Expected an error for an unknown backend")
+	}
+
+	registerBackend("mock", func() (Backend, error) {
+		return &mockSkydns{make(map[string]*msg.Service)}, nil
+	})
+	defer delete(backendFactories, "mock")
+
+	b, err := newBackend("mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*mockSkydns); !ok {
+		t.Fatalf("Expected the mock backend got %T", b)
+	}
+}
+
+func TestPurgeDroppedBackends(t *testing.T) {
+	defer func(backends backendList) { params.Backends = backends }(params.Backends)
+	defer func() { registrations = newRegistrationTable() }()
+
+	var (
+		redis1 = &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "192.168.1.10", Port: 6379}
+		old    = &mockSkydns{map[string]*msg.Service{"aaaaaaaaaa": redis1, "manual": redis1}}
+	)
+	registerBackend("old", func() (Backend, error) { return old, nil })
+	defer delete(backendFactories, "old")
+	registerBackend("broken", func() (Backend, error) { return nil, fmt.Errorf("missing flags") })
+	defer delete(backendFactories, "broken")
+
+	registrations = newRegistrationTable()
+	params.Backends = backendList{"old"}
+	registrations.set("aaaaaaaaaa", []registration{{UUID: "aaaaaaaaaa", Service: redis1}})
+
+	// skydock restarts with another backend
+	params.Backends = backendList{"skydns"}
+	if err := purgeDroppedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	if old.services["aaaaaaaaaa"] != nil || old.services["manual"] == nil {
+		t.Fatalf("Expected only the recorded service to be removed from the dropped backend got %v", old.services)
+	}
+	if records, _ := registrations.get("aaaaaaaaaa"); len(records[0].Backends) != 1 || records[0].Backends[0] != "skydns" {
+		t.Fatalf("Expected the service to be recorded against skydns got %v", records[0].Backends)
+	}
+
+	// a dropped backend that cannot be created stops skydock
+	registrations.set("bbbbbbbbbb", []registration{{UUID: "bbbbbbbbbb", Service: redis1, Backends: []string{"broken"}}})
+	if err := purgeDroppedBackends(); err == nil {
+		t.Fatal("Expected an error for a dropped backend that cannot be created")
+	}
+}
+
+func TestEtcdKey(t *testing.T) {
+	service := &msg.Service{Name: "redis", Version: "redis1", Environment: "dev"}
+	if key := etcdKey("/skydns", "docker", "aaaaaaaaaa", service); key != "/skydns/docker/dev/redis/redis1/aaaaaaaaaa" {
+		t.Fatalf("Expected /skydns/docker/dev/redis/redis1/aaaaaaaaaa got %s", key)
+	}
+
+	service = &msg.Service{Name: "_http._tcp.web", Version: "web1", Environment: "backend.dev"}
+	if key := etcdKey("/skydns", "example.com.", "bbbbbbbbbb-80", service); key != "/skydns/com/example/dev/backend/web/_tcp/_http/web1/bbbbbbbbbb-80" {
+		t.Fatalf("Unexpected key %s", key)
+	}
+}
+
+// fakeConsul is a stand-in for the consul agent API
+type fakeConsul struct {
+	sync.Mutex
+	services map[string]*consulService
+	passes   map[string]int
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case r.Method == "PUT" && r.URL.Path == "/v1/agent/service/register":
+		var service consulService
+		if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.services[service.ID] = &service
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		if _, exists := f.services[id]; !exists {
+			http.Error(w, "Unknown service ID "+id, http.StatusNotFound)
+			return
+		}
+		delete(f.services, id)
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/service:"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/service:")
+		if _, exists := f.services[id]; !exists {
+			// what older agents answer
+			http.Error(w, "Unknown check ID \"service:"+id+"\"", http.StatusInternalServerError)
+			return
+		}
+		f.passes[id]++
+	case r.Method == "GET" && r.URL.Path == "/v1/agent/services":
+		json.NewEncoder(w).Encode(f.services)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulBackend(t *testing.T) {
+	params.TTL = 30
+	// the labels come from when the services were created, not from docker
+	dockerClient = &mockDocker{map[string]*docker.Container{}}
+	registrations = newRegistrationTable()
+	registrations.setLabels("aaaaaaaaaa", map[string]string{tagsLabel: "primary, cache"})
+
+	agent := &fakeConsul{services: make(map[string]*consulService), passes: make(map[string]int)}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+
+	c := newConsulClient(server.URL, "")
+	service := &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379, TTL: 30}
+
+	if err := c.Add("aaaaaaaaaa", service); err != nil {
+		t.Fatal(err)
+	}
+
+	registered := agent.services["aaaaaaaaaa"]
+	if registered == nil {
+		t.Fatal("Expected the service to be registered")
+	}
+	if registered.Name != "redis" || registered.Address != "172.17.0.4" || registered.Port != 6379 {
+		t.Fatalf("Unexpected registration %v", registered)
+	}
+	if tags := strings.Join(registered.Tags, ","); tags != "dev,redis1,primary,cache" {
+		t.Fatalf("Expected tags dev,redis1,primary,cache got %s", tags)
+	}
+	if registered.Check == nil || registered.Check.TTL != "30s" {
+		t.Fatalf("Expected a 30s TTL check got %v", registered.Check)
+	}
+
+	// port services go under the plain name tagged with the port name
+	port := &msg.Service{Name: "_db._tcp.redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379, TTL: 30}
+	if err := c.Add("aaaaaaaaaa-1", port); err != nil {
+		t.Fatal(err)
+	}
+	registered = agent.services["aaaaaaaaaa-1"]
+	if registered == nil || registered.Name != "redis" {
+		t.Fatalf("Expected the port service registered as redis got %v", registered)
+	}
+	if tags := strings.Join(registered.Tags, ","); tags != "dev,redis1,primary,cache,db" {
+		t.Fatalf("Expected tags dev,redis1,primary,cache,db got %s", tags)
+	}
+
+	if err := c.Update("aaaaaaaaaa", 30); err != nil {
+		t.Fatal(err)
+	}
+	if agent.passes["aaaaaaaaaa"] != 2 {
+		t.Fatalf("Expected the check to pass on add and update got %d", agent.passes["aaaaaaaaaa"])
+	}
+
+	services, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].UUID < services[j].UUID })
+	if len(services) != 2 || services[0].UUID != "aaaaaaaaaa" || !sameService(services[0], service) {
+		t.Fatalf("Expected the registered services from List got %v", services)
+	}
+	if services[1].UUID != "aaaaaaaaaa-1" || !sameService(services[1], port) {
+		t.Fatalf("Expected the port service under its skydock name from List got %v", services[1])
+	}
+
+	if err := c.Delete("aaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("aaaaaaaaaa"); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected deleting twice to be not found got %v", err)
+	}
+	if err := c.Update("aaaaaaaaaa", 30); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected updating a deregistered service to be not found got %v", err)
+	}
+}
+
+// fakeZone is a primary nameserver that applies RFC 2136 updates signed
+// with its TSIG key and serves zone transfers
+type fakeZone struct {
+	sync.Mutex
+	zone    string
+	records []dns.RR
+}
+
+func (z *fakeZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	z.Lock()
+	defer z.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	switch {
+	case req.Opcode == dns.OpcodeUpdate:
+		for _, rr := range req.Ns {
+			z.apply(rr)
+		}
+	case req.Question[0].Qtype == dns.TypeAXFR:
+		soa := &dns.SOA{Hdr: dns.RR_Header{Name: z.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Ns: "ns." + z.zone, Mbox: "hostmaster." + z.zone}
+		m.Answer = append(append([]dns.RR{soa}, z.records...), soa)
+	}
+
+	m.SetTsig(req.IsTsig().Hdr.Name, dns.HmacSHA256, 300, time.Now().Unix())
+	w.WriteMsg(m)
+}
+
+func (z *fakeZone) apply(rr dns.RR) {
+	header := rr.Header()
+	var kept []dns.RR
+	for _, record := range z.records {
+		remove := false
+		switch header.Class {
+		case dns.ClassANY:
+			remove = record.Header().Name == header.Name && (header.Rrtype == dns.TypeANY || record.Header().Rrtype == header.Rrtype)
+		case dns.ClassNONE:
+			copied := dns.Copy(rr)
+			copied.Header().Class = dns.ClassINET
+			remove = dns.IsDuplicate(record, copied)
+		case dns.ClassINET:
+			remove = dns.IsDuplicate(record, rr)
+		}
+		if !remove {
+			kept = append(kept, record)
+		}
+	}
+	if header.Class == dns.ClassINET {
+		kept = append(kept, rr)
+	}
+	z.records = kept
+}
+
+func (z *fakeZone) names(qtype uint16) map[string]int {
+	z.Lock()
+	defer z.Unlock()
+
+	out := make(map[string]int)
+	for _, rr := range z.records {
+		if rr.Header().Rrtype == qtype {
+			out[rr.Header().Name]++
+		}
+	}
+	return out
+}
+
+func TestRFC2136Backend(t *testing.T) {
+	params.TTL = 30
+	registrations = newRegistrationTable()
+	secret := "c2t5ZG9jay10ZXN0LXNlY3JldA=="
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := &fakeZone{zone: "docker."}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          l,
+		Handler:           zone,
+		TsigSecret:        map[string]string{"skydock.": secret},
+		NotifyStartedFunc: func() { close(started) },
+		// the default refuses updates
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	if _, err := newRFC2136Client(l.Addr().String(), "docker", "skydock", dns.HmacSHA256); err == nil {
+		t.Fatal("Expected an error for a key without a secret")
+	}
+	b, err := newRFC2136Client(l.Addr().String(), "docker", "skydock:"+secret, dns.HmacSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redis1 := &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+	redis2 := &msg.Service{Name: "redis", Version: "redis2", Environment: "dev", Host: "fd00::5", Port: 6379}
+	if err := b.Add("aaaaaaaaaa", redis1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("bbbbbbbbbb", redis2); err != nil {
+		t.Fatal(err)
+	}
+
+	if a := zone.names(dns.TypeA); a["redis1.redis.dev.docker."] != 1 || a["redis.dev.docker."] != 1 {
+		t.Fatalf("Unexpected A records %v", a)
+	}
+	if aaaa := zone.names(dns.TypeAAAA); aaaa["redis2.redis.dev.docker."] != 1 || aaaa["redis.dev.docker."] != 1 {
+		t.Fatalf("Unexpected AAAA records %v", aaaa)
+	}
+	if srv := zone.names(dns.TypeSRV); srv["redis.dev.docker."] != 2 {
+		t.Fatalf("Expected two SRV records for redis.dev.docker got %v", srv)
+	}
+
+	// a new backend, as after a restart, finds the records with a transfer
+	restarted, _ := newRFC2136Client(l.Addr().String(), "docker", "skydock:"+secret, dns.HmacSHA256)
+	services, err := restarted.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services got %v", services)
+	}
+	for _, service := range services {
+		if service.UUID == "aaaaaaaaaa" && !sameService(service, redis1) {
+			t.Fatalf("Expected redis1 got %v", service)
+		}
+	}
+
+	if err := restarted.Delete("aaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Delete("aaaaaaaaaa"); err != client.ErrServiceNotFound {
+		t.Fatalf("Expected deleting twice to be not found got %v", err)
+	}
+	if a := zone.names(dns.TypeA); len(a) != 0 {
+		t.Fatalf("Expected the A records to be removed got %v", a)
+	}
+	if srv := zone.names(dns.TypeSRV); srv["redis.dev.docker."] != 1 || srv["redis2.redis.dev.docker."] != 1 {
+		t.Fatalf("Expected only redis2 SRV records got %v", srv)
+	}
+
+	// a container recreated under the same name and address keeps its
+	// records when the old one is deleted
+	web1 := &msg.Service{Name: "web", Version: "web1", Environment: "dev", Host: "172.17.0.7", Port: 80}
+	if err := b.Add("dddddddddd", web1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("eeeeeeeeee", web1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("dddddddddd"); err != nil {
+		t.Fatal(err)
+	}
+	if a := zone.names(dns.TypeA); a["web1.web.dev.docker."] != 1 || a["web.dev.docker."] != 1 {
+		t.Fatalf("Expected the A records of the new container to be kept got %v", a)
+	}
+	services, err = b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids := make(map[string]bool)
+	for _, service := range services {
+		uuids[service.UUID] = true
+	}
+	if !uuids["eeeeeeeeee"] || uuids["dddddddddd"] {
+		t.Fatalf("Expected only the new container to be listed got %v", uuids)
+	}
+
+	unsigned, _ := newRFC2136Client(l.Addr().String(), "docker", "", "")
+	if err := unsigned.Add("cccccccccc", redis1); err == nil {
+		t.Fatal("Expected an unsigned update to be refused")
+	}
+
+	// a refused transfer lists the registered services instead
+	registrations = newRegistrationTable()
+	registrations.set("bbbbbbbbbb", []registration{{UUID: "bbbbbbbbbb", Service: redis2}})
+	services, err = unsigned.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].UUID != "bbbbbbbbbb" {
+		t.Fatalf("Expected the registered service got %v", services)
+	}
+}
+
+func TestHostsBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+
+	hup := make(chan os.Signal, 10)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	b, err := newHostsFile(path, "docker.", os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redis1 := &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+	if err := b.Add("aaaaaaaaaa", redis1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("aaaaaaaaaa", redis1); err != client.ErrConflictingUUID {
+		t.Fatalf("Expected a conflict adding the uuid again got %v", err)
+	}
+	if err := b.Add("aaaaaaaaaa-1", &msg.Service{Name: "_redis._tcp.redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}); err != nil {
+		t.Fatal(err)
+	}
+	// a second service of the same container shares the short name
+	if err := b.Add("aaaaaaaaaa-2", &msg.Service{Name: "sentinel", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 26379}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("bbbbbbbbbb", &msg.Service{Name: "web", Version: "web1", Environment: "dev", Host: "fd00::5", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("cccccccccc", &msg.Service{Name: "my_app", Version: "my_app1", Environment: "dev", Host: "172.17.0.6", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-hup:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a SIGHUP after the file changed")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "172.17.0.4\tredis1.redis.dev.docker redis1\t") {
+		t.Fatalf("Expected an entry for redis1 got\n%s", content)
+	}
+	if !strings.Contains(string(content), "fd00::5\tweb1.web.dev.docker web1\t") {
+		t.Fatalf("Expected an entry for web1 got\n%s", content)
+	}
+	if !strings.Contains(string(content), "172.17.0.6\tmy_app1.my_app.dev.docker my_app1\t") {
+		t.Fatalf("Expected an entry for my_app1 got\n%s", content)
+	}
+	if strings.Contains(string(content), "_tcp") {
+		t.Fatalf("Expected no entries for port services got\n%s", content)
+	}
+	if !strings.Contains(string(content), "172.17.0.4\tredis1.sentinel.dev.docker\t") || strings.Count(string(content), " redis1\t") != 1 {
+		t.Fatalf("Expected redis1 only once for 172.17.0.4 got\n%s", content)
+	}
+
+	if err := b.Delete("aaaaaaaaaa-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("bbbbbbbbbb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("cccccccccc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new backend, as after a restart, reads the services from the file
+	restarted, err := newHostsFile(path, "docker", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := restarted.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].UUID != "aaaaaaaaaa" || !sameService(services[0], redis1) {
+		t.Fatalf("Expected redis1 from the file got %v", services)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected only the hosts file to be left got %d files", len(files))
+	}
+}
+
+func TestZoneBackend(t *testing.T) {
+	params.TTL = 30
+
+	dir, err := ioutil.TempDir("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "docker.zone")
+	reloaded := filepath.Join(dir, "reloaded")
+
+	b, err := newZoneFile(path, "docker", "ns1.example.com", "touch "+reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redis1 := &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+	if err := b.Add("aaaaaaaaaa", redis1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("bbbbbbbbbb", &msg.Service{Name: "redis", Version: "redis2", Environment: "dev", Host: "fd00::5", Port: 6379}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("bbbbbbbbbb"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Fatalf("Expected the reload command to run: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var (
+		soa    *dns.SOA
+		a, srv int
+		parser = dns.NewZoneParser(f, "", path)
+	)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soa = rr
+		case *dns.A:
+			a++
+		case *dns.AAAA:
+			t.Fatalf("Expected the AAAA records of the deleted service to be gone got %s", rr)
+		case *dns.SRV:
+			srv++
+		}
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if soa == nil || soa.Serial != 3 || soa.Ns != "ns1.example.com." {
+		t.Fatalf("Expected an SOA with serial 3 got %v", soa)
+	}
+	if a != 2 || srv != 2 {
+		t.Fatalf("Expected 2 A and 2 SRV records got %d and %d", a, srv)
+	}
+
+	// a new backend, as after a restart, continues the serial and knows the services
+	restarted, err := newZoneFile(path, "docker", "ns1.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, _ := restarted.List()
+	if len(services) != 1 || services[0].UUID != "aaaaaaaaaa" || !sameService(services[0], redis1) {
+		t.Fatalf("Expected redis1 from the zone file got %v", services)
+	}
+	if err := restarted.Delete("aaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.serial != 4 {
+		t.Fatalf("Expected serial 4 got %d", restarted.serial)
+	}
+}
+
+// gatedSkydns blocks every call until gate is closed and fails the
+// first failures calls
+type gatedSkydns struct {
+	*mockSkydns
+	gate     chan struct{}
+	failures int
+}
+
+func (s *gatedSkydns) wait() error {
+	<-s.gate
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("backend is down")
+	}
+	return nil
+}
+
+func (s *gatedSkydns) Add(uuid string, service *msg.Service) error {
+	if err := s.wait(); err != nil {
+		return err
+	}
+	return s.mockSkydns.Add(uuid, service)
+}
+
+func (s *gatedSkydns) Delete(uuid string) error {
+	if err := s.wait(); err != nil {
+		return err
+	}
+	return s.mockSkydns.Delete(uuid)
+}
+
+func waitForPending(t *testing.T, m *outbox, pending int) backendStats {
+	for i := 0; i < 500; i++ {
+		if stats := m.snapshot(); stats.Pending == pending {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d pending operations on %s got %d", pending, m.name, m.snapshot().Pending)
+	return backendStats{}
+}
+
+func TestFanout(t *testing.T) {
+	var (
+		fast, _ = newOutbox("fast", &mockSkydns{make(map[string]*msg.Service)}, "", true)
+		gated   = &gatedSkydns{mockSkydns: &mockSkydns{make(map[string]*msg.Service)}, gate: make(chan struct{}), failures: 1}
+		slow, _ = newOutbox("slow", gated, "", true)
+		f       = &fanout{members: []*outbox{fast, slow}}
+		redis1  = &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+	)
+	defer f.Close()
+
+	if err := f.Add("aaaaaaaaaa", redis1); err != nil {
+		t.Fatal(err)
+	}
+	f.Update("aaaaaaaaaa", 30)
+	f.Update("aaaaaaaaaa", 30)
+
+	// the fast backend is not held up by the blocked one
+	waitForPending(t, fast, 0)
+	if fast.backend.(*mockSkydns).services["aaaaaaaaaa"] == nil {
+		t.Fatal("Expected the fast backend to have the service")
+	}
+	if stats := slow.snapshot(); stats.Pending != 1 {
+		t.Fatalf("Expected only the add pending on the slow backend got %d", stats.Pending)
+	}
+
+	// the first attempt fails and is retried
+	close(gated.gate)
+	stats := waitForPending(t, slow, 0)
+	if stats.Failed != 1 || stats.Sent != 1 || stats.LastError != "backend is down" {
+		t.Fatalf("Unexpected stats %s", stats)
+	}
+	if gated.services["aaaaaaaaaa"] == nil {
+		t.Fatal("Expected the slow backend to have the service after the retry")
+	}
+
+	services, err := f.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("Expected the service once got %v", services)
+	}
+
+	f.Delete("aaaaaaaaaa")
+	f.Delete("aaaaaaaaaa")
+	waitForPending(t, fast, 0)
+	waitForPending(t, slow, 0)
+	if len(fast.backend.(*mockSkydns).services)+len(gated.services) != 0 {
+		t.Fatal("Expected the service to be deleted from both backends")
+	}
+}
+
+// flakySkydns fails every call while down and records the calls it
+// accepted in order
+type flakySkydns struct {
+	*mockSkydns
+	sync.Mutex
+	down  bool
+	calls []string
+}
+
+func (s *flakySkydns) call(name, uuid string) error {
+	if s.down {
+		return fmt.Errorf("backend is down")
+	}
+	s.calls = append(s.calls, name+" "+uuid)
+	return nil
+}
+
+func (s *flakySkydns) Add(uuid string, service *msg.Service) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.call("add", uuid); err != nil {
+		return err
+	}
+	return s.mockSkydns.Add(uuid, service)
+}
+
+func (s *flakySkydns) Delete(uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.call("delete", uuid); err != nil {
+		return err
+	}
+	return s.mockSkydns.Delete(uuid)
+}
+
+func (s *flakySkydns) Update(uuid string, ttl uint32) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.call("update", uuid); err != nil {
+		return err
+	}
+	return s.mockSkydns.Update(uuid, ttl)
+}
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path   = filepath.Join(dir, "outbox")
+		flaky  = &flakySkydns{mockSkydns: &mockSkydns{make(map[string]*msg.Service)}, down: true}
+		redis1 = &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+		redis2 = &msg.Service{Name: "redis", Version: "redis2", Environment: "dev", Host: "172.17.0.5", Port: 6379}
+	)
+
+	o, err := newOutbox("skydns", flaky, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Add("aaaaaaaaaa", redis1); err == nil || err.Error() != "backend is down" {
+		t.Fatalf("Expected the error of the failed add got %v", err)
+	}
+	// the heartbeat is covered by the waiting add
+	if err := o.Update("aaaaaaaaaa", 30); err != errQueued {
+		t.Fatalf("Expected the update to be queued got %v", err)
+	}
+	// the add is superseded by the delete of the same service
+	o.Add("aaaaaaaaaa-1", redis1)
+	o.Delete("aaaaaaaaaa-1")
+	o.Add("bbbbbbbbbb", redis2)
+	// even once it was tried
+	o.Add("cccccccccc", redis1)
+	o.Delete("cccccccccc")
+
+	stats := o.snapshot()
+	if stats.Pending != 4 || stats.Failed != 3 || stats.LastError != "backend is down" {
+		t.Fatalf("Unexpected stats %s", stats)
+	}
+	o.Close()
+
+	// the waiting operations survive a restart
+	restarted, err := newOutbox("skydns", flaky, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if stats := restarted.snapshot(); stats.Pending != 4 {
+		t.Fatalf("Expected 4 operations loaded got %d", stats.Pending)
+	}
+
+	flaky.Lock()
+	flaky.down = false
+	flaky.Unlock()
+	waitForPending(t, restarted, 0)
+
+	flaky.Lock()
+	defer flaky.Unlock()
+	var containerA []string
+	for _, call := range flaky.calls {
+		if strings.Contains(call, "aaaaaaaaaa") {
+			containerA = append(containerA, call)
+		}
+	}
+	if strings.Join(containerA, ",") != "add aaaaaaaaaa,delete aaaaaaaaaa-1" {
+		t.Fatalf("Expected the operations of the container in order got %v", containerA)
+	}
+	if len(flaky.services) != 2 || flaky.services["aaaaaaaaaa-1"] != nil {
+		t.Fatalf("Unexpected services %v", flaky.services)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "[]" {
+		t.Fatalf("Expected an empty outbox on disk got %s", content)
+	}
+}
+
+func TestOutboxSavesRetriesOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path   = filepath.Join(dir, "outbox")
+		flaky  = &flakySkydns{mockSkydns: &mockSkydns{make(map[string]*msg.Service)}}
+		redis1 = &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+	)
+	o, err := newOutbox("skydns", flaky, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	// operations the backend takes are never written
+	if err := o.Add("aaaaaaaaaa", redis1); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Update("aaaaaaaaaa", 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected no outbox on disk got %v", err)
+	}
+
+	flaky.Lock()
+	flaky.down = true
+	flaky.Unlock()
+	if err := o.Update("aaaaaaaaaa", 30); !isQueued(err) {
+		t.Fatalf("Expected the update to be queued got %v", err)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(content), "aaaaaaaaaa") {
+		t.Fatalf("Expected the queued update on disk got %s %v", content, err)
+	}
+
+	flaky.Lock()
+	flaky.down = false
+	flaky.Unlock()
+	o.retry("aaaaaaaaaa")
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "[]" {
+		t.Fatalf("Expected an empty outbox on disk got %s %v", content, err)
+	}
+}
+
+func TestRegistrationState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(delay time.Duration) { stateSaveDelay = delay }(stateSaveDelay)
+	stateSaveDelay = time.Hour
+
+	defer func(backends backendList) { params.Backends = backends }(params.Backends)
+	params.Backends = backendList{"skydns"}
+
+	var (
+		path   = filepath.Join(dir, "state")
+		redis1 = &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "192.168.1.10", Port: 6379}
+	)
+
+	defer func() { registrations = newRegistrationTable() }()
+	registrations = newRegistrationTable()
+	if err := registrations.load(path); err != nil {
+		t.Fatal(err)
+	}
+	registrations.set("aaaaaaaaaa", []registration{{UUID: "aaaaaaaaaa", Service: redis1}})
+	registrations.set("dddddddddd", nil)
+
+	// changes are coalesced and written by the scheduled flush
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the state file to wait for the flush got %v", err)
+	}
+	registrations.flush()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []stateEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries got %s", content)
+	}
+	if entry := entries[0]; entry.Container != "aaaaaaaaaa" || entry.UUID != "aaaaaaaaaa" || entry.Service.Host != redis1.Host ||
+		len(entry.Backends) != 1 || entry.Backends[0] != "skydns" || entry.Updated.IsZero() {
+		t.Fatalf("Unexpected entry %v", entry)
+	}
+
+	// skydock restarts after the container died
+	registrations = newRegistrationTable()
+	if err := registrations.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := registrations.get("aaaaaaaaaa"); len(records) != 1 || records[0].Service.Version != "redis1" {
+		t.Fatalf("Expected the registration to be restored got %v", records)
+	}
+
+	// records keep the backends they were added to when -backend changes
+	params.Backends = backendList{"skydns", "etcd"}
+	registrations.set("dddddddddd", []registration{{UUID: "dddddddddd", Service: redis1}})
+	if records, _ := registrations.get("aaaaaaaaaa"); len(records[0].Backends) != 1 || records[0].Backends[0] != "skydns" {
+		t.Fatalf("Expected the restored record to keep its backend got %v", records[0].Backends)
+	}
+	if records, _ := registrations.get("dddddddddd"); len(records[0].Backends) != 2 {
+		t.Fatalf("Expected the new record on both backends got %v", records[0].Backends)
+	}
+	params.Backends = backendList{"skydns"}
+	registrations.remove("dddddddddd")
+
+	backend = &mockSkydns{map[string]*msg.Service{
+		"aaaaaaaaaa": redis1,
+		// looks like skydock's but the state file does not list it
+		"bbbbbbbbbb": {Name: "redis", Version: "redis2", Environment: "dev", Host: "192.168.1.11", Port: 6379},
+	}}
+	dockerClient = &mockDocker{containers: map[string]*docker.Container{}}
+
+	summary, err := reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Removed != 1 {
+		t.Fatalf("Expected 1 removed got %s", summary)
+	}
+	services := backend.(*mockSkydns).services
+	if services["aaaaaaaaaa"] != nil {
+		t.Fatal("Expected the record of the dead container to be removed")
+	}
+	if services["bbbbbbbbbb"] == nil {
+		t.Fatal("Expected the record not in the state file to be kept")
+	}
+
+	registrations.flush()
+	if content, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "[]" {
+		t.Fatalf("Expected an empty state file got %s", content)
+	}
+
+	// destroying a container still removes its leftovers with -state
+	defer func(hostID string) { params.HostID = hostID }(params.HostID)
+	params.HostID = "host1"
+	redis3 := &msg.Service{Name: "redis", Version: "redis3", Environment: "dev", Region: "host1", Host: "192.168.1.12", Port: 6379}
+	services["cccccccccc"] = redis3
+	services["cccccccccc-2"] = redis3
+	registrations.set("cccccccccc", []registration{{UUID: "cccccccccc", Service: redis3}})
+
+	if err := purgeContainer("cccccccccc"); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services["bbbbbbbbbb"] == nil {
+		t.Fatalf("Expected only the record not owned to be left got %v", services)
+	}
+}
+
+func TestQueuedRegistration(t *testing.T) {
+	p, err := newRuntime("plugins/default.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins = p
+
+	flaky := &flakySkydns{mockSkydns: &mockSkydns{make(map[string]*msg.Service)}, down: true}
+	o, err := newOutbox("skydns", flaky, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	backend = o
+	registrations = newRegistrationTable()
+	refresher = newRefreshScheduler(refreshService)
+	dockerClient = &mockDocker{
+		containers: map[string]*docker.Container{
+			"aaaaaaaaaa": {
+				Id:              "aaaaaaaaaa",
+				Image:           "olitvin/redis:latest",
+				Name:            "/redis1",
+				NetworkSettings: &docker.NetworkSettings{IpAddress: "192.168.1.10"},
+				State:           docker.State{Running: true},
+			},
+		},
+	}
+
+	// the backend is down, the caller hears about it but the add is kept
+	if err := addService("aaaaaaaaaa", "olitvin/redis"); !isQueued(err) || err.Error() != "backend is down" {
+		t.Fatalf("Expected the queued error of the add got %v", err)
+	}
+	if _, exists := registrations.get("aaaaaaaaaa"); !exists {
+		t.Fatal("Expected the queued service to be registered")
+	}
+	if scheduled := refresher.scheduled(); len(scheduled) != 1 || scheduled[0].UUID != "aaaaaaaaaa" {
+		t.Fatalf("Expected the queued service to be refreshed got %v", scheduled)
+	}
+
+	flaky.Lock()
+	flaky.down = false
+	flaky.Unlock()
+	o.retry("aaaaaaaaaa")
+	if flaky.services["aaaaaaaaaa"] == nil {
+		t.Fatal("Expected the retried add to reach the backend")
+	}
+
+	// the retried record is removed when the container dies
+	handleContainerEvent(&docker.Event{Type: docker.TypeContainer, Action: "die", ContainerId: "aaaaaaaaaa"})
+	if len(flaky.services) != 0 || len(refresher.scheduled()) != 0 {
+		t.Fatalf("Expected the service to be removed got %v", flaky.services)
+	}
+}
+
+func TestOutboxOrder(t *testing.T) {
+	var (
+		gated  = &gatedSkydns{mockSkydns: &mockSkydns{make(map[string]*msg.Service)}, gate: make(chan struct{}), failures: 1}
+		redis1 = &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+	)
+	o, err := newOutbox("skydns", gated, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	added := make(chan error)
+	go func() { added <- o.Add("aaaaaaaaaa", redis1) }()
+	waitForPending(t, o, 1)
+
+	// the delete waits for the add that is still being applied
+	if err := o.Delete("aaaaaaaaaa"); err != errQueued {
+		t.Fatalf("Expected the delete to be queued got %v", err)
+	}
+
+	close(gated.gate)
+	if err := <-added; err == nil {
+		t.Fatal("Expected the first attempt of the add to fail")
+	}
+	waitForPending(t, o, 0)
+	if len(gated.services) != 0 {
+		t.Fatalf("Expected the delete to be applied after the retried add got %v", gated.services)
+	}
+}
+
+func TestFanoutFailing(t *testing.T) {
+	var (
+		down1     = &flakySkydns{mockSkydns: &mockSkydns{make(map[string]*msg.Service)}, down: true}
+		down2     = &flakySkydns{mockSkydns: &mockSkydns{make(map[string]*msg.Service)}, down: true}
+		first, _  = newOutbox("first", down1, "", true)
+		second, _ = newOutbox("second", down2, "", true)
+		f         = &fanout{members: []*outbox{first, second}}
+		redis1    = &msg.Service{Name: "redis", Version: "redis1", Environment: "dev", Host: "172.17.0.4", Port: 6379}
+	)
+	defer f.Close()
+
+	f.Add("aaaaaaaaaa", redis1)
+	for _, m := range f.members {
+		for i := 0; i < 500 && m.snapshot().Failed == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := f.Delete("aaaaaaaaaa"); err == nil {
+		t.Fatal("Expected an error when every backend is failing")
+	}
+
+	down1.Lock()
+	down1.down = false
+	down1.Unlock()
+	waitForPending(t, first, 0)
+	if err := f.Add("bbbbbbbbbb", redis1); err != nil {
+		t.Fatalf("Expected no error while one backend works got %s", err)
+	}
+
+	backend = f
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/debug/backends", nil))
+	var metrics []backendStats
+	if err := json.NewDecoder(w.Body).Decode(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 || metrics[0].Name != "first" || metrics[1].Name != "second" || metrics[1].Failed == 0 {
+		t.Fatalf("Unexpected metrics %v", metrics)
+	}
+}
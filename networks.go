@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/olitvin/skydock/docker"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+const (
+	// networkLabel names the network whose address is registered
+	// for a container, it overrides the -network flag
+	networkLabel = "skydock.network"
+
+	// networkNonBridge selects the first network, by name, that
+	// is not docker's default bridge
+	networkNonBridge = "first-nonbridge"
+
+	defaultBridge = "bridge"
+)
+
+// selectAddress chooses the address to register for the container and
+// stores it in NetworkSettings.IpAddress so plugins pick it up.  The
+// network comes from the container's skydock.network label, then from
+// -network; without either the default bridge address is kept and
+// containers only attached to user defined networks use the first of them
+func selectAddress(container *docker.Container) string {
+	settings := container.NetworkSettings
+	if settings == nil {
+		return ""
+	}
+
+	network := params.Network
+	if name, exists := containerLabels(container)[networkLabel]; exists {
+		network = name
+	}
+
+	switch network {
+	case "":
+	case networkNonBridge:
+		if address := firstNetworkAddress(settings, true); address != "" {
+			settings.IpAddress = address
+		}
+	default:
+		if endpoint, exists := settings.Networks[network]; exists && endpoint != nil && endpoint.IPAddress != "" {
+			settings.IpAddress = endpoint.IPAddress
+		}
+	}
+
+	if settings.IpAddress == "" {
+		settings.IpAddress = firstNetworkAddress(settings, false)
+	}
+	return settings.IpAddress
+}
+
+// firstNetworkAddress returns the address of the first network by name
+// that has one, skipping the default bridge when nonBridge is set
+func firstNetworkAddress(settings *docker.NetworkSettings, nonBridge bool) string {
+	for _, name := range networkNames(settings) {
+		if nonBridge && name == defaultBridge {
+			continue
+		}
+		if endpoint := settings.Networks[name]; endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress
+		}
+	}
+	return ""
+}
+
+func networkNames(settings *docker.NetworkSettings) []string {
+	names := make([]string, 0, len(settings.Networks))
+	for name := range settings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// networkServices copies every service registered at address once for each
+// network of the container, with the network name in front of the
+// environment so they resolve as instance.service.network.environment.domain
+func networkServices(container *docker.Container, address string, services []*msg.Service) []*msg.Service {
+	settings := container.NetworkSettings
+	if settings == nil || address == "" {
+		return nil
+	}
+
+	var out []*msg.Service
+	for _, name := range networkNames(settings) {
+		endpoint := settings.Networks[name]
+		if endpoint == nil || endpoint.IPAddress == "" {
+			continue
+		}
+		for _, service := range services {
+			if service.Host != address {
+				continue
+			}
+			record := *service
+			record.Host = endpoint.IPAddress
+			record.Environment = name + "." + service.Environment
+			out = append(out, &record)
+		}
+	}
+	return out
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+const (
+	minOutboxBackoff = time.Second
+	maxOutboxBackoff = time.Minute
+)
+
+const (
+	opAdd    = "add"
+	opDelete = "delete"
+	opUpdate = "update"
+)
+
+// queuedError is the error of an operation the backend did not take but
+// the outbox keeps and retries, callers treat the operation as sent and
+// only report the error
+type queuedError struct {
+	err error
+}
+
+func (e *queuedError) Error() string {
+	return e.err.Error()
+}
+
+// isQueued reports whether err is for an operation the outbox retries
+func isQueued(err error) bool {
+	_, ok := err.(*queuedError)
+	return ok
+}
+
+// errQueued is returned for an operation queued behind operations of
+// the same container the backend failed
+var errQueued error = &queuedError{errors.New("queued behind operations the backend failed")}
+
+// backendOp is an operation waiting in an outbox
+type backendOp struct {
+	Kind    string
+	UUID    string
+	Service *msg.Service `json:",omitempty"`
+	TTL     uint32       `json:",omitempty"`
+}
+
+// backendStats are the metrics of the outbox of one backend
+type backendStats struct {
+	Name        string
+	Sent        uint64
+	Failed      uint64
+	Pending     int
+	LastError   string
+	LastSuccess time.Time
+}
+
+func (s backendStats) String() string {
+	out := fmt.Sprintf("backend %s: %d sent, %d failed, %d pending", s.Name, s.Sent, s.Failed, s.Pending)
+	if s.LastError != "" {
+		out += ", last error: " + s.LastError
+	}
+	return out
+}
+
+// containerQueue holds the operations of one container, they are applied
+// in order and the first one is retried until the backend accepts it
+type containerQueue struct {
+	ops      []backendOp
+	failures int
+	next     time.Time
+	// busy is set while the first operation is being applied
+	busy bool
+}
+
+// outbox sits in front of a backend and keeps the operations the backend
+// failed so they are retried with backoff instead of being lost.  Once a
+// container has operations waiting all of its later operations wait behind
+// them, and an operation replaces the waiting ones it supersedes.  An async
+// outbox queues every operation so callers never wait for the backend.
+// When path is set the operations waiting for a retry are saved there and
+// loaded again when skydock starts, operations the backend takes right
+// away are never written
+type outbox struct {
+	name    string
+	backend Backend
+	path    string
+	async   bool
+
+	sync.Mutex
+	queues map[string]*containerQueue
+	// services remembers what was added so an expired service can be
+	// added again when the backend reports it missing on update
+	services map[string]*msg.Service
+	stats    backendStats
+	// failing is set while the last operation applied failed
+	failing bool
+	// saved is set while path holds operations
+	saved bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newOutbox(name string, b Backend, path string, async bool) (*outbox, error) {
+	o := &outbox{
+		name:     name,
+		backend:  b,
+		path:     path,
+		async:    async,
+		queues:   make(map[string]*containerQueue),
+		services: make(map[string]*msg.Service),
+		stats:    backendStats{Name: name},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	go o.run()
+	return o, nil
+}
+
+func (o *outbox) Add(uuid string, service *msg.Service) error {
+	return o.send(backendOp{Kind: opAdd, UUID: uuid, Service: service})
+}
+
+func (o *outbox) Delete(uuid string) error {
+	return o.send(backendOp{Kind: opDelete, UUID: uuid})
+}
+
+func (o *outbox) Update(uuid string, ttl uint32) error {
+	return o.send(backendOp{Kind: opUpdate, UUID: uuid, TTL: ttl})
+}
+
+func (o *outbox) List() ([]*msg.Service, error) {
+	return o.backend.List()
+}
+
+// Close stops retrying, tries every waiting operation once more and
+// closes the backend.  What is still waiting is only kept if the outbox is
+// saved to disk
+func (o *outbox) Close() error {
+	close(o.stop)
+	<-o.done
+
+	o.Lock()
+	ids := make([]string, 0, len(o.queues))
+	for id := range o.queues {
+		ids = append(ids, id)
+	}
+	o.Unlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		o.retry(id)
+	}
+
+	if pending := o.snapshot().Pending; pending > 0 && o.path == "" {
+		log.Printf(log.WARN, "dropping %d operations backend %s did not take", pending, o.name)
+	}
+	return o.backend.Close()
+}
+
+// send applies op right away unless the outbox is async or the container
+// already has operations waiting.  A failed operation stays queued for
+// retry and its error is returned as a queuedError, as is errQueued for an
+// operation queued behind one that failed, so callers still see that the
+// backend did not take it yet
+func (o *outbox) send(op backendOp) error {
+	id := containerUUID(op.UUID)
+
+	o.Lock()
+	if q := o.queues[id]; o.async || (q != nil && len(q.ops) > 0) {
+		o.enqueue(op)
+		defer o.Unlock()
+		if !o.async {
+			return errQueued
+		}
+		if o.failing {
+			return &queuedError{fmt.Errorf("backend %s is failing, queued: %s", o.name, o.stats.LastError)}
+		}
+		return nil
+	}
+	// queue op while it is applied so later operations of the container
+	// wait behind it
+	q := &containerQueue{ops: []backendOp{op}, busy: true}
+	o.queues[id] = q
+	o.Unlock()
+
+	err := o.apply(op)
+
+	o.Lock()
+	defer o.Unlock()
+	q.busy = false
+	if err == nil {
+		q.ops = q.ops[1:]
+		if len(q.ops) == 0 {
+			delete(o.queues, id)
+		}
+		if o.saved {
+			o.save()
+		}
+		return nil
+	}
+
+	o.stats.Failed++
+	o.stats.LastError = err.Error()
+	q.failures = 1
+	q.next = time.Now().Add(minOutboxBackoff)
+	o.save()
+	log.Printf(log.WARN, "backend %s failed to %s %s, retrying in %s: %s", o.name, op.Kind, op.UUID, minOutboxBackoff, err)
+	return &queuedError{err}
+}
+
+// enqueue adds op to the queue of its container, removing the waiting
+// operations it supersedes.  The lock must be held
+func (o *outbox) enqueue(op backendOp) {
+	id := containerUUID(op.UUID)
+	q := o.queues[id]
+	if q == nil {
+		q = &containerQueue{}
+		o.queues[id] = q
+	}
+
+	var (
+		kept    []backendOp
+		pending bool
+	)
+	for i, waiting := range q.ops {
+		if waiting.UUID == op.UUID {
+			switch {
+			case op.Kind == opUpdate && waiting.Kind != opDelete,
+				op.Kind == opDelete && waiting.Kind == opDelete:
+				// the waiting operation already does the same
+				pending = true
+			case waiting.Kind != opDelete && (i > 0 || !q.busy && (q.failures == 0 || op.Kind == opDelete)):
+				// superseded by the new add or delete.  An add that was
+				// already tried may be half applied and is only replaced
+				// by a delete, which removes whatever it left
+				continue
+			}
+		}
+		kept = append(kept, waiting)
+	}
+	if !pending {
+		kept = append(kept, op)
+	}
+	q.ops = kept
+
+	// only operations that wait for a retry are worth saving, an async
+	// operation to a working backend is applied right away
+	if o.saved || o.failing || q.failures > 0 {
+		o.save()
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run retries the first operation of every container whose backoff
+// expired until stopped
+func (o *outbox) run() {
+	defer close(o.done)
+
+	for {
+		for _, id := range o.due() {
+			o.retry(id)
+		}
+
+		wait := o.nextRetry()
+		select {
+		case <-o.wake:
+		case <-time.After(wait):
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// due returns the containers whose first operation should be tried now
+func (o *outbox) due() []string {
+	o.Lock()
+	defer o.Unlock()
+
+	var (
+		out []string
+		now = time.Now()
+	)
+	for id, q := range o.queues {
+		if len(q.ops) > 0 && !q.busy && !q.next.After(now) {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// nextRetry returns how long to sleep until the next backoff expires
+func (o *outbox) nextRetry() time.Duration {
+	o.Lock()
+	defer o.Unlock()
+
+	wait := maxOutboxBackoff
+	for _, q := range o.queues {
+		if len(q.ops) == 0 {
+			continue
+		}
+		if d := q.next.Sub(time.Now()); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// retry applies the first operations of the container id until one fails
+func (o *outbox) retry(id string) {
+	for {
+		o.Lock()
+		q := o.queues[id]
+		if q == nil || len(q.ops) == 0 {
+			delete(o.queues, id)
+			if o.saved {
+				o.save()
+			}
+			o.Unlock()
+			return
+		}
+		if q.busy {
+			// send is applying it
+			o.Unlock()
+			return
+		}
+		op := q.ops[0]
+		q.busy = true
+		o.Unlock()
+
+		err := o.apply(op)
+
+		o.Lock()
+		q.busy = false
+		if err != nil {
+			q.failures++
+			backoff := minOutboxBackoff << uint(q.failures-1)
+			if backoff > maxOutboxBackoff || backoff <= 0 {
+				backoff = maxOutboxBackoff
+			}
+			q.next = time.Now().Add(backoff)
+			o.stats.Failed++
+			o.stats.LastError = err.Error()
+			if !o.saved {
+				o.save()
+			}
+			o.Unlock()
+			log.Printf(log.ERROR, "backend %s failed to %s %s, retrying in %s: %s", o.name, op.Kind, op.UUID, backoff, err)
+			return
+		}
+
+		q.ops = q.ops[1:]
+		q.failures = 0
+		q.next = time.Time{}
+		if o.saved {
+			o.save()
+		}
+		o.Unlock()
+	}
+}
+
+// apply sends one operation with the error handling sendService,
+// removeService and refreshService expect from the backend
+func (o *outbox) apply(op backendOp) error {
+	var err error
+	switch op.Kind {
+	case opAdd:
+		if err = o.backend.Add(op.UUID, op.Service); err == client.ErrConflictingUUID {
+			err = o.backend.Update(op.UUID, op.Service.TTL)
+		}
+		if err == nil {
+			o.Lock()
+			o.services[op.UUID] = op.Service
+			o.Unlock()
+		}
+	case opDelete:
+		if err = o.backend.Delete(op.UUID); err == client.ErrServiceNotFound {
+			err = nil
+		}
+		if err == nil {
+			o.Lock()
+			delete(o.services, op.UUID)
+			o.Unlock()
+		}
+	case opUpdate:
+		if err = o.backend.Update(op.UUID, op.TTL); err == client.ErrServiceNotFound {
+			o.Lock()
+			service, exists := o.services[op.UUID]
+			o.Unlock()
+			if !exists {
+				// registered before skydock restarted
+				service, exists = registrations.service(op.UUID)
+			}
+			if exists {
+				log.Printf(log.WARN, "%s expired in backend %s, adding it again", op.UUID, o.name)
+				err = o.backend.Add(op.UUID, service)
+			} else {
+				err = nil
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown operation %s", op.Kind)
+	}
+
+	o.Lock()
+	if o.failing = err != nil; !o.failing {
+		o.stats.Sent++
+		o.stats.LastSuccess = time.Now()
+	}
+	o.Unlock()
+	return err
+}
+
+func (o *outbox) snapshot() backendStats {
+	o.Lock()
+	defer o.Unlock()
+
+	stats := o.stats
+	for _, q := range o.queues {
+		stats.Pending += len(q.ops)
+	}
+	return stats
+}
+
+// save writes the waiting operations to path.  Once saved every change is
+// written until the outbox is empty again.  The lock must be held
+func (o *outbox) save() {
+	if o.path == "" {
+		return
+	}
+
+	ids := make([]string, 0, len(o.queues))
+	for id := range o.queues {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	ops := []backendOp{}
+	for _, id := range ids {
+		ops = append(ops, o.queues[id].ops...)
+	}
+
+	content, err := json.Marshal(ops)
+	if err == nil {
+		err = writeFileAtomic(o.path, content)
+	}
+	if err == nil {
+		o.saved = len(ops) > 0
+	}
+	if err != nil {
+		log.Printf(log.ERROR, "error saving the outbox of backend %s to %s: %s", o.name, o.path, err)
+	}
+}
+
+// load queues the operations saved in path
+func (o *outbox) load() error {
+	if o.path == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var ops []backendOp
+	if err := json.Unmarshal(content, &ops); err != nil {
+		return fmt.Errorf("cannot read outbox %s: %s", o.path, err)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	for _, op := range ops {
+		id := containerUUID(op.UUID)
+		if o.queues[id] == nil {
+			o.queues[id] = &containerQueue{}
+		}
+		o.queues[id].ops = append(o.queues[id].ops, op)
+	}
+	o.saved = len(ops) > 0
+	if len(ops) > 0 {
+		log.Printf(log.INFO, "loaded %d operations for backend %s from %s", len(ops), o.name, o.path)
+	}
+	return nil
+}
+
+// backendMetrics returns the metrics of every configured backend
+func backendMetrics() []backendStats {
+	switch b := backend.(type) {
+	case *outbox:
+		return []backendStats{b.snapshot()}
+	case *fanout:
+		return b.stats()
+	}
+	return nil
+}
+
+// serveMetrics serves the metrics of every backend as JSON at /debug/backends
+// on addr, kept off /metrics where scrapers expect the Prometheus text format
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/backends", metricsHandler)
+	return http.ListenAndServe(addr, mux)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backendMetrics())
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/olitvin/skydock/docker"
 	log "github.com/olitvin/skydock/slog"
@@ -11,11 +16,150 @@ import (
 	"github.com/skynetservices/skydns1/msg"
 )
 
+// servicePlugin creates the services to register for a container
+type servicePlugin interface {
+	createService(container *docker.Container) ([]*msg.Service, error)
+}
+
+// pluginRuntime is a single javascript VM, it must not be used
+// by more than one goroutine at a time
 type pluginRuntime struct {
 	o *otto.Otto
+
+	// source is kept so a broken runtime can be replaced
+	source  string
+	timeout time.Duration
+	// broken is set when a call panicked or was interrupted
+	// and the VM may be left in an inconsistent state
+	broken bool
+}
+
+var (
+	errPluginTimeout = errors.New("createService plugin timed out")
+
+	// pluginFailures counts failed plugin calls since skydock started
+	pluginFailures uint64
+)
+
+// createServices runs the plugins for the container uuid, retrying up to
+// -pluginretries times.  A failure only affects this container
+func createServices(uuid string, container *docker.Container) ([]*msg.Service, error) {
+	registrations.setLabels(uuid, containerLabels(container))
+
+	var err error
+	for attempt := 0; attempt <= params.PluginRetries; attempt++ {
+		var services []*msg.Service
+		if services, err = buildServices(currentPlugins(), container); err == nil {
+			return services, nil
+		}
+
+		failures := atomic.AddUint64(&pluginFailures, 1)
+		log.Printf(log.ERROR, "plugin failed for %s (attempt %d, %d failures total): %s", uuid, attempt+1, failures, err)
+	}
+	return nil, fmt.Errorf("plugin failed for %s: %s", uuid, err)
 }
 
-func (r *pluginRuntime) createService(container *docker.Container) (*msg.Service, error) {
+// buildServices selects the container's address, runs the plugins and
+// adds the per network services when -pernetwork is set
+func buildServices(p servicePlugin, container *docker.Container) ([]*msg.Service, error) {
+	address := selectAddress(container)
+
+	services, err := p.createService(container)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.PerNetwork {
+		services = append(services, networkServices(container, address, services)...)
+	}
+	// ownership relies on the region, it replaces whatever the plugin set
+	for _, service := range services {
+		service.Region = params.HostID
+	}
+	return services, nil
+}
+
+// pluginPool hands out independently initialized runtimes so concurrent
+// workers never share a VM
+type pluginPool struct {
+	runtimes chan *pluginRuntime
+}
+
+func newPluginPool(file string, size int) (*pluginPool, error) {
+	if size < 1 {
+		size = 1
+	}
+	log.Printf(log.INFO, "loading %d plugin runtimes from %s", size, file)
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &pluginPool{runtimes: make(chan *pluginRuntime, size)}
+	for i := 0; i < size; i++ {
+		runtime, err := loadRuntime(string(content))
+		if err != nil {
+			return nil, err
+		}
+		pool.runtimes <- runtime
+	}
+	return pool, nil
+}
+
+// createService runs createService on the next free runtime, a runtime
+// left broken by the call is replaced with a fresh one
+func (p *pluginPool) createService(container *docker.Container) ([]*msg.Service, error) {
+	runtime := <-p.runtimes
+	defer func() {
+		p.runtimes <- runtime
+	}()
+
+	services, err := runtime.createService(container)
+	if runtime.broken {
+		log.Printf(log.WARN, "replacing plugin runtime after failure: %s", err)
+		if fresh, rerr := loadRuntime(runtime.source); rerr == nil {
+			runtime = fresh
+		} else {
+			log.Printf(log.ERROR, "cannot reload plugin runtime: %s", rerr)
+		}
+	}
+	return services, err
+}
+
+// createService runs the createService plugin for the container, stopping it
+// after the runtime's timeout.  Panics inside the VM are returned as errors
+func (r *pluginRuntime) createService(container *docker.Container) (services []*msg.Service, err error) {
+	defer func() {
+		if caught := recover(); caught != nil {
+			r.broken = true
+			if caught == errPluginTimeout {
+				err = errPluginTimeout
+				return
+			}
+			err = fmt.Errorf("createService plugin panicked: %v", caught)
+		}
+	}()
+
+	if r.timeout > 0 {
+		// a new channel per call so a late timer cannot interrupt the next call
+		interrupt := make(chan func(), 1)
+		r.o.Interrupt = interrupt
+
+		timer := time.AfterFunc(r.timeout, func() {
+			interrupt <- func() {
+				panic(errPluginTimeout)
+			}
+		})
+		defer timer.Stop()
+	}
+	return r.call(container)
+}
+
+// call runs the createService plugin for the container.  The plugin
+// returns a service object or an array of them and each service is followed
+// by one service per entry in its optional Ports array
+func (r *pluginRuntime) call(container *docker.Container) ([]*msg.Service, error) {
 	value, err := r.o.ToValue(*container)
 	if err != nil {
 		return nil, err
@@ -30,10 +174,40 @@ func (r *pluginRuntime) createService(container *docker.Container) (*msg.Service
 		return nil, fmt.Errorf("createService plugin did not return a valid object")
 	}
 
+	if result.Class() != "Array" {
+		return getService(result.Object())
+	}
+
 	var (
-		obj     = result.Object()
-		service = &msg.Service{}
+		array  = result.Object()
+		out    []*msg.Service
+		length int64
 	)
+	if length, err = getInt(array, "length"); err != nil {
+		return nil, err
+	}
+
+	for i := int64(0); i < length; i++ {
+		v, err := array.Get(strconv.FormatInt(i, 10))
+		if err != nil {
+			return nil, err
+		}
+		if !v.IsObject() {
+			return nil, fmt.Errorf("createService plugin returned an array with an invalid object at %d", i)
+		}
+
+		services, err := getService(v.Object())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, services...)
+	}
+	return out, nil
+}
+
+// getService converts a service object returned by a plugin
+func getService(obj *otto.Object) ([]*msg.Service, error) {
+	service := &msg.Service{}
 
 	rawTTL, err := getInt(obj, "TTL")
 	if err != nil {
@@ -60,27 +234,113 @@ func (r *pluginRuntime) createService(container *docker.Container) (*msg.Service
 	service.TTL = uint32(rawTTL)
 	service.Port = uint16(rawPort)
 
+	ports, err := getPorts(obj, service)
+	if err != nil {
+		return nil, err
+	}
+
 	// I'm glad that is over
-	return service, nil
+	return append([]*msg.Service{service}, ports...), nil
+}
+
+// getPorts converts the Ports array of a plugin result into one SRV style
+// service per port named _name._protocol.service
+func getPorts(obj *otto.Object, service *msg.Service) ([]*msg.Service, error) {
+	v, err := obj.Get("Ports")
+	if err != nil {
+		return nil, err
+	}
+	if !v.IsDefined() || v.IsNull() {
+		return nil, nil
+	}
+	if !v.IsObject() || v.Class() != "Array" {
+		return nil, fmt.Errorf("createService plugin returned Ports that is not an array")
+	}
+
+	var (
+		ports  = v.Object()
+		out    []*msg.Service
+		length int64
+	)
+	if length, err = getInt(ports, "length"); err != nil {
+		return nil, err
+	}
+
+	for i := int64(0); i < length; i++ {
+		p, err := ports.Get(strconv.FormatInt(i, 10))
+		if err != nil {
+			return nil, err
+		}
+		if !p.IsObject() {
+			return nil, fmt.Errorf("createService plugin returned a port that is not an object")
+		}
+
+		rawPort, err := getInt(p.Object(), "Port")
+		if err != nil {
+			return nil, err
+		}
+		name, err := getString(p.Object(), "Name")
+		if err != nil {
+			return nil, err
+		}
+		protocol, err := getString(p.Object(), "Protocol")
+		if err != nil {
+			return nil, err
+		}
+		if protocol == "" || protocol == "undefined" {
+			protocol = "tcp"
+		}
+		if name == "" || name == "undefined" {
+			name = utils.PortName(int(rawPort), protocol)
+		}
+
+		port := *service
+		port.Name = fmt.Sprintf("_%s._%s.%s", name, protocol, service.Name)
+		port.Port = uint16(rawPort)
+		out = append(out, &port)
+	}
+
+	// keep the order, and so the derived uuids, stable between calls
+	sort.Sort(byPort(out))
+	return out, nil
+}
+
+type byPort []*msg.Service
+
+func (b byPort) Len() int      { return len(b) }
+func (b byPort) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPort) Less(i, j int) bool {
+	if b[i].Port != b[j].Port {
+		return b[i].Port < b[j].Port
+	}
+	return b[i].Name < b[j].Name
 }
 
 func newRuntime(file string) (*pluginRuntime, error) {
-	runtime := otto.New()
 	log.Println(log.INFO, "loading plugins from", file)
 
 	content, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
+	return loadRuntime(string(content))
+}
 
-	if _, err := runtime.Run(string(content)); err != nil {
+// loadRuntime creates a runtime from the plugin source
+func loadRuntime(content string) (*pluginRuntime, error) {
+	runtime := otto.New()
+	if _, err := runtime.Run(content); err != nil {
 		return nil, err
 	}
 
 	if err := loadDefaults(runtime); err != nil {
 		return nil, err
 	}
-	return &pluginRuntime{runtime}, nil
+	return &pluginRuntime{
+		o:       runtime,
+		source:  content,
+		timeout: time.Duration(params.PluginTimeout) * time.Millisecond,
+	}, nil
 }
 
 func loadDefaults(runtime *otto.Otto) error {
@@ -104,11 +364,44 @@ func loadDefaults(runtime *otto.Otto) error {
 	}); err != nil {
 		return err
 	}
+	if err := runtime.Set("labels", func(call otto.FunctionCall) otto.Value {
+		var labels map[string]string
+		if exported, err := call.Argument(0).Export(); err == nil {
+			switch container := exported.(type) {
+			case docker.Container:
+				labels = containerLabels(&container)
+			case *docker.Container:
+				labels = containerLabels(container)
+			}
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		result, _ := call.Otto.ToValue(labels)
+		return result
+	}); err != nil {
+		return err
+	}
+	if err := runtime.Set("portName", func(call otto.FunctionCall) otto.Value {
+		port, _ := call.Argument(0).ToInteger()
+		protocol := call.Argument(1).String()
+		result, _ := otto.ToValue(utils.PortName(int(port), protocol))
+		return result
+	}); err != nil {
+		return err
+	}
 	return nil
 }
 
 // util functions
 
+func containerLabels(container *docker.Container) map[string]string {
+	if container == nil || container.Config == nil {
+		return nil
+	}
+	return container.Config.Labels
+}
+
 func getString(obj *otto.Object, name string) (string, error) {
 	v, err := obj.Get(name)
 	if err != nil {
@@ -6,7 +6,8 @@ function createService(container) {
         TTL: defaultTTL,
         Service: cleanImageName(container.Image),
         Instance: removeSlash(container.Name),
-        Host: container.NetworkSettings.IpAddress
+        Host: container.NetworkSettings.IpAddress,
+        Ports: getPorts(container)
     }; 
 }
 
@@ -37,3 +38,28 @@ function getDefaultPort(container) {
     }
     return port;
 }
+
+// every exposed port gets its own SRV record named after the
+// well known service of the container port, _http._tcp for 80/tcp
+function getPorts(container) {
+    var out = [];
+    var ports = container.NetworkSettings.Ports;
+    for (var key in ports) {
+        var parts = key.split("/");
+        var expose = parseInt(parts[0]);
+        var protocol = parts[1] || "tcp";
+        var port = expose;
+
+        var value = ports[key];
+        if (value !== null && value.length > 0) {
+            port = parseInt(value[0].HostPort);
+        }
+
+        out.push({
+            Name: portName(expose, protocol),
+            Protocol: protocol,
+            Port: port
+        });
+    }
+    return out;
+}
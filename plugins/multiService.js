@@ -0,0 +1,45 @@
+// this plugin registers a container under every service
+// listed in its DNS_SERVICES env var, DNS_SERVICES=api:8080,metrics:9100
+function createService(container) {
+    var services = getServices(container);
+    if (services.length === 0) {
+        services.push({
+            Name: cleanImageName(container.Image),
+            Port: 80
+        });
+    }
+
+    var out = [];
+    for (var i = 0; i < services.length; i++) {
+        out.push({
+            Port: services[i].Port,
+            Environment: defaultEnvironment,
+            TTL: defaultTTL,
+            Service: services[i].Name,
+            Instance: removeSlash(container.Name),
+            Host: container.NetworkSettings.IpAddress
+        });
+    }
+    return out;
+}
+
+function getServices(container) {
+    var out = [];
+    var env = container.Config.Env;
+    for (var i = 0; i < env.length; i++) {
+        var parts = env[i].split("=");
+        if (parts[0] !== "DNS_SERVICES") {
+            continue;
+        }
+
+        var names = parts[1].split(",");
+        for (var j = 0; j < names.length; j++) {
+            var service = names[j].split(":");
+            out.push({
+                Name: service[0],
+                Port: parseInt(service[1] || "80")
+            });
+        }
+    }
+    return out;
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/olitvin/skydock/docker"
+	log "github.com/olitvin/skydock/slog"
+	"github.com/olitvin/skydock/utils"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// reconcileSummary counts the changes made by a reconciliation pass
+type reconcileSummary struct {
+	Added   int
+	Updated int
+	Removed int
+	Failed  int
+}
+
+func (s *reconcileSummary) String() string {
+	return fmt.Sprintf("%d added, %d updated, %d removed, %d failed", s.Added, s.Updated, s.Removed, s.Failed)
+}
+
+// reconcile makes skydns match the containers running on this host.  Every
+// running container is registered or has its TTL refreshed and records
+// owned by this host that no longer map to a running container are removed
+func reconcile() (*reconcileSummary, error) {
+	containers, err := dockerClient.FetchAllContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		summary  = &reconcileSummary{}
+		existing = make(map[string][]registration)
+		alive    = make(map[string]struct{})
+		state    = registrations.snapshot()
+	)
+
+	for _, record := range records {
+		if registrations.owned(record) {
+			uuid := containerUUID(record.UUID)
+			existing[uuid] = append(existing[uuid], registration{UUID: record.UUID, Service: record})
+		}
+	}
+
+	for _, cnt := range containers {
+		uuid := utils.Truncate(cnt.Id)
+
+		container, err := dockerClient.FetchContainer(uuid, cnt.Image)
+		if err != nil {
+			alive[uuid] = struct{}{}
+			if err != docker.ErrImageNotTagged {
+				log.Printf(log.ERROR, "failed to fetch %s on reconcile: %s", cnt.Id, err)
+				summary.Failed++
+			}
+			continue
+		}
+		if !shouldRegister(container) {
+			// treated like a stopped container so its records are removed
+			continue
+		}
+		alive[uuid] = struct{}{}
+
+		services, err := createServices(uuid, container)
+		if err != nil {
+			summary.Failed++
+			continue
+		}
+
+		records, exists := existing[uuid]
+		switch {
+		case !exists:
+			if err := sendServices(uuid, services); err != nil {
+				log.Printf(log.ERROR, "failed to send %s to skydns on reconcile: %s", uuid, err)
+				summary.Failed++
+				continue
+			}
+			summary.Added++
+		case sameServices(uuid, records, services):
+			if err := refreshServices(uuid, services); err != nil {
+				log.Printf(log.ERROR, "failed to update %s on reconcile: %s", uuid, err)
+				summary.Failed++
+				continue
+			}
+			summary.Updated++
+		default:
+			// the container changed while we were not watching, replace its records
+			registrations.set(uuid, records)
+			if err := removeService(uuid); err != nil {
+				log.Printf(log.ERROR, "failed to remove stale %s on reconcile: %s", uuid, err)
+			}
+			if err := sendServices(uuid, services); err != nil {
+				log.Printf(log.ERROR, "failed to send %s to skydns on reconcile: %s", uuid, err)
+				summary.Failed++
+				continue
+			}
+			summary.Updated++
+		}
+	}
+
+	// the state file also knows records the backend does not list
+	for uuid, records := range state {
+		if _, exists := alive[uuid]; exists {
+			continue
+		}
+		if len(records) == 0 {
+			registrations.remove(uuid)
+			continue
+		}
+		if _, exists := existing[uuid]; !exists {
+			existing[uuid] = records
+		}
+	}
+
+	for uuid, records := range existing {
+		if _, exists := alive[uuid]; exists {
+			continue
+		}
+		registrations.set(uuid, records)
+		if err := removeService(uuid); err != nil {
+			log.Printf(log.ERROR, "failed to remove %s on reconcile: %s", uuid, err)
+			summary.Failed++
+			continue
+		}
+		summary.Removed++
+	}
+
+	log.Printf(log.INFO, "reconciled with skydns: %s", summary)
+	return summary, nil
+}
+
+// refreshServices resets the TTL of every service of the container
+// uuid that is already in skydns and starts refreshing them
+func refreshServices(uuid string, services []*msg.Service) error {
+	records := make([]registration, len(services))
+	for i, service := range services {
+		id := serviceUUID(uuid, i)
+		if err := updateService(id, params.TTL); err != nil {
+			return err
+		}
+		records[i] = registration{UUID: id, Service: service}
+	}
+
+	registrations.set(uuid, records)
+	for _, record := range records {
+		refresher.schedule(record.UUID)
+	}
+	return nil
+}
+
+// ownedService reports whether a record was registered by skydock on this
+// host, which stamps -hostid as the region of every service.  Records of
+// other hosts sharing the backend and unstamped records are never owned
+func ownedService(service *msg.Service) bool {
+	return params.HostID != "" && service.Region == params.HostID
+}
+
+// sameServices reports whether the records registered for the container
+// uuid still describe its services
+func sameServices(uuid string, records []registration, services []*msg.Service) bool {
+	if len(records) != len(services) {
+		return false
+	}
+
+	registered := make(map[string]*msg.Service, len(records))
+	for _, record := range records {
+		registered[record.UUID] = record.Service
+	}
+	for i, service := range services {
+		record, exists := registered[serviceUUID(uuid, i)]
+		if !exists || !sameService(record, service) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameService reports whether a registered record still describes service
+func sameService(record, service *msg.Service) bool {
+	return record.Name == service.Name &&
+		record.Version == service.Version &&
+		record.Environment == service.Environment &&
+		record.Host == service.Host &&
+		record.Port == service.Port
+}
+
+// resync compares the running containers with the registration table and
+// repairs any difference, logging each correction.  Unlike reconcile it
+// does not query skydns so it is cheap enough to run periodically
+func resync() (*reconcileSummary, error) {
+	// snapshot before listing containers so that a container registered by
+	// an event in between is not mistaken for a dead one
+	registered := registrations.snapshot()
+
+	containers, err := dockerClient.FetchAllContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		summary = &reconcileSummary{}
+		alive   = make(map[string]struct{})
+	)
+
+	for _, cnt := range containers {
+		uuid := utils.Truncate(cnt.Id)
+		alive[uuid] = struct{}{}
+
+		if _, exists := registered[uuid]; exists {
+			continue
+		}
+		if err := addService(uuid, cnt.Image); err != nil {
+			log.Printf(log.ERROR, "resync: failed to add %s: %s", uuid, err)
+			summary.Failed++
+			continue
+		}
+		if _, exists := registrations.get(uuid); exists {
+			log.Printf(log.WARN, "resync: %s was running but not registered, added", uuid)
+			summary.Added++
+		}
+	}
+
+	for uuid := range registered {
+		if _, exists := alive[uuid]; exists {
+			continue
+		}
+		if err := removeService(uuid); err != nil {
+			log.Printf(log.ERROR, "resync: failed to remove %s: %s", uuid, err)
+			summary.Failed++
+			continue
+		}
+		log.Printf(log.WARN, "resync: %s was registered but not running, removed", uuid)
+		summary.Removed++
+	}
+
+	if summary.Added+summary.Removed+summary.Failed > 0 {
+		log.Printf(log.INFO, "resync made corrections: %s", summary)
+	}
+	return summary, nil
+}
+
+// resyncLoop runs resync every interval
+func resyncLoop(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if _, err := resync(); err != nil {
+			log.Printf(log.ERROR, "error during resync: %s", err)
+		}
+	}
+}
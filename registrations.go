@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// registration is a single service skydock added to skydns and the
+// backends it was added to
+type registration struct {
+	UUID     string
+	Service  *msg.Service
+	Backends []string
+}
+
+// stateSaveDelay coalesces the changes saved to the state file
+var stateSaveDelay = time.Second
+
+// registrationTable is skydock's own record of the services it
+// registered, keyed by the uuid of the container they belong to.  Once
+// loaded from a state file its changes are saved to it, at most once per
+// stateSaveDelay and without holding the table lock while writing
+type registrationTable struct {
+	sync.Mutex
+	containers map[string][]registration
+	updated    map[string]time.Time
+	// labels are the container labels backends read, such as the consul
+	// tags, so they do not have to ask docker
+	labels map[string]map[string]string
+
+	path string
+	// dirty is set while changes wait for the scheduled flush
+	dirty bool
+	// writing serializes flushes so an older snapshot never overwrites
+	// a newer one
+	writing sync.Mutex
+}
+
+func newRegistrationTable() *registrationTable {
+	return &registrationTable{
+		containers: make(map[string][]registration),
+		updated:    make(map[string]time.Time),
+		labels:     make(map[string]map[string]string),
+	}
+}
+
+// set replaces the records of the container uuid.  Records without
+// backends were just added to the current -backend list
+func (t *registrationTable) set(uuid string, records []registration) {
+	stamped := make([]registration, len(records))
+	for i, record := range records {
+		if record.Backends == nil {
+			record.Backends = append([]string(nil), params.Backends...)
+		}
+		stamped[i] = record
+	}
+
+	t.Lock()
+	t.containers[uuid] = stamped
+	t.updated[uuid] = time.Now()
+	t.save()
+	t.Unlock()
+}
+
+func (t *registrationTable) remove(uuid string) {
+	t.Lock()
+	delete(t.containers, uuid)
+	delete(t.updated, uuid)
+	delete(t.labels, uuid)
+	t.save()
+	t.Unlock()
+}
+
+// setLabels remembers the labels of the container uuid
+func (t *registrationTable) setLabels(uuid string, labels map[string]string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if reflect.DeepEqual(t.labels[uuid], labels) {
+		return
+	}
+	t.labels[uuid] = labels
+	t.save()
+}
+
+// label returns the label name of the container uuid
+func (t *registrationTable) label(uuid, name string) string {
+	t.Lock()
+	defer t.Unlock()
+	return t.labels[uuid][name]
+}
+
+func (t *registrationTable) get(uuid string) ([]registration, bool) {
+	t.Lock()
+	defer t.Unlock()
+	records, exists := t.containers[uuid]
+	return records, exists
+}
+
+// service returns the registered service with the given service uuid
+func (t *registrationTable) service(uuid string) (*msg.Service, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, record := range t.containers[containerUUID(uuid)] {
+		if record.UUID == uuid {
+			return record.Service, true
+		}
+	}
+	return nil, false
+}
+
+// services returns every registered service with its UUID set
+func (t *registrationTable) services() []*msg.Service {
+	t.Lock()
+	defer t.Unlock()
+
+	var out []*msg.Service
+	for _, records := range t.containers {
+		for _, record := range records {
+			if record.Service == nil {
+				continue
+			}
+			service := *record.Service
+			service.UUID = record.UUID
+			out = append(out, &service)
+		}
+	}
+	return out
+}
+
+// snapshot returns a copy of the table that is safe to iterate
+func (t *registrationTable) snapshot() map[string][]registration {
+	t.Lock()
+	defer t.Unlock()
+
+	out := make(map[string][]registration, len(t.containers))
+	for uuid, records := range t.containers {
+		out[uuid] = records
+	}
+	return out
+}
+
+// owned reports whether skydock registered the record, either because the
+// table lists it or because it carries this host's -hostid
+func (t *registrationTable) owned(service *msg.Service) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, record := range t.containers[containerUUID(service.UUID)] {
+		if record.UUID == service.UUID {
+			return true
+		}
+	}
+	return ownedService(service)
+}
+
+// droppedBackends returns the uuids of the services recorded against each
+// backend that is no longer in -backend
+func (t *registrationTable) droppedBackends() map[string][]string {
+	t.Lock()
+	defer t.Unlock()
+
+	configured := make(map[string]struct{}, len(params.Backends))
+	for _, name := range params.Backends {
+		configured[name] = struct{}{}
+	}
+
+	out := make(map[string][]string)
+	for _, records := range t.containers {
+		for _, record := range records {
+			for _, name := range record.Backends {
+				if _, exists := configured[name]; !exists {
+					out[name] = append(out[name], record.UUID)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// moveBackends records every service against the -backend list once the
+// dropped backends are cleaned up, reconciliation adds them to new ones
+func (t *registrationTable) moveBackends() {
+	t.Lock()
+	defer t.Unlock()
+
+	for uuid, records := range t.containers {
+		moved := make([]registration, len(records))
+		for i, record := range records {
+			record.Backends = append([]string(nil), params.Backends...)
+			moved[i] = record
+		}
+		t.containers[uuid] = moved
+	}
+	t.save()
+}
+
+// stateEntry is a service in the state file.  A container registered
+// without services has a single entry with an empty UUID
+type stateEntry struct {
+	Container string
+	UUID      string            `json:",omitempty"`
+	Service   *msg.Service      `json:",omitempty"`
+	Backends  []string          `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	Updated   time.Time
+}
+
+// load reads the state file at path and saves every later change to it.
+// A missing file is a first run with nothing registered yet
+func (t *registrationTable) load(path string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.path = path
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf(log.INFO, "no state file at %s yet, starting with nothing registered", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []stateEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("cannot read state file %s: %s", path, err)
+	}
+
+	for _, entry := range entries {
+		records := t.containers[entry.Container]
+		if entry.UUID != "" {
+			records = append(records, registration{UUID: entry.UUID, Service: entry.Service, Backends: entry.Backends})
+		}
+		t.containers[entry.Container] = records
+		t.updated[entry.Container] = entry.Updated
+		if entry.Labels != nil {
+			t.labels[entry.Container] = entry.Labels
+		}
+	}
+	log.Printf(log.INFO, "loaded %d containers from %s", len(t.containers), path)
+	return nil
+}
+
+// save schedules writing the table to the state file.  The lock must be
+// held
+func (t *registrationTable) save() {
+	if t.path == "" || t.dirty {
+		return
+	}
+	t.dirty = true
+	time.AfterFunc(stateSaveDelay, t.flush)
+}
+
+// flush writes pending changes to the state file, skydock calls it once
+// more before exiting
+func (t *registrationTable) flush() {
+	t.writing.Lock()
+	defer t.writing.Unlock()
+
+	t.Lock()
+	if !t.dirty {
+		t.Unlock()
+		return
+	}
+	t.dirty = false
+	path, entries := t.path, t.entries()
+	t.Unlock()
+
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, content)
+	}
+	if err != nil {
+		log.Printf(log.ERROR, "error saving state to %s: %s", path, err)
+	}
+}
+
+// entries returns the table as state file entries.  The lock must be held
+func (t *registrationTable) entries() []stateEntry {
+	entries := []stateEntry{}
+	for uuid, records := range t.containers {
+		if len(records) == 0 {
+			entries = append(entries, stateEntry{Container: uuid, Labels: t.labels[uuid], Updated: t.updated[uuid]})
+		}
+		for _, record := range records {
+			entries = append(entries, stateEntry{
+				Container: uuid,
+				UUID:      record.UUID,
+				Service:   record.Service,
+				Backends:  record.Backends,
+				Labels:    t.labels[uuid],
+				Updated:   t.updated[uuid],
+			})
+		}
+	}
+	sort.Sort(byContainer(entries))
+	return entries
+}
+
+type byContainer []stateEntry
+
+func (b byContainer) Len() int      { return len(b) }
+func (b byContainer) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byContainer) Less(i, j int) bool {
+	if b[i].Container != b[j].Container {
+		return b[i].Container < b[j].Container
+	}
+	return b[i].UUID < b[j].UUID
+}
+
+// serviceUUID returns the uuid of the i-th service of a container,
+// the first service keeps the uuid of the container
+func serviceUUID(uuid string, i int) string {
+	if i == 0 {
+		return uuid
+	}
+	return fmt.Sprintf("%s-%d", uuid, i)
+}
+
+// containerUUID returns the container uuid a service uuid was derived from
+func containerUUID(uuid string) string {
+	if i := strings.Index(uuid, "-"); i != -1 {
+		return uuid[:i]
+	}
+	return uuid
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/olitvin/skydock/docker"
+	log "github.com/olitvin/skydock/slog"
+	"github.com/olitvin/skydock/utils"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// pluginsLock guards swapping plugins while workers use them
+var pluginsLock sync.RWMutex
+
+func currentPlugins() servicePlugin {
+	pluginsLock.RLock()
+	defer pluginsLock.RUnlock()
+	return plugins
+}
+
+func setPlugins(p servicePlugin) {
+	pluginsLock.Lock()
+	plugins = p
+	pluginsLock.Unlock()
+}
+
+// reloadPlugins loads the plugins file into new runtimes and validates them
+// against every running container before swapping them in.  With -reregister
+// containers whose services changed are registered again
+func reloadPlugins() error {
+	pool, err := newPluginPool(params.PluginFile, params.NumberOfHandlers)
+	if err != nil {
+		return err
+	}
+
+	containers, err := dockerClient.FetchAllContainers()
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[string][]*msg.Service)
+	for _, cnt := range containers {
+		uuid := utils.Truncate(cnt.Id)
+
+		container, err := dockerClient.FetchContainer(uuid, cnt.Image)
+		if err != nil {
+			if err != docker.ErrImageNotTagged {
+				log.Printf(log.ERROR, "failed to fetch %s to validate plugins: %s", cnt.Id, err)
+			}
+			continue
+		}
+
+		services, err := buildServices(pool, container)
+		if err != nil {
+			return fmt.Errorf("new plugins fail for %s, keeping the old ones: %s", uuid, err)
+		}
+
+		// containers skydock left out, such as paused ones, stay out
+		records, exists := registrations.get(uuid)
+		if exists && shouldRegister(container) && !sameServices(uuid, records, services) {
+			changed[uuid] = services
+		}
+	}
+
+	setPlugins(pool)
+	log.Printf(log.INFO, "reloaded plugins from %s, %d containers have different services", params.PluginFile, len(changed))
+
+	if !params.Reregister {
+		return nil
+	}
+	for uuid, services := range changed {
+		if err := sendServices(uuid, services); err != nil {
+			log.Printf(log.ERROR, "failed to register %s again after reload: %s", uuid, err)
+		}
+	}
+	return nil
+}
+
+// watchPlugins reloads the plugins whenever the modification time
+// or size of file changes
+func watchPlugins(file string, interval time.Duration) {
+	last, err := os.Stat(file)
+	if err != nil {
+		log.Printf(log.ERROR, "cannot watch plugins %s: %s", file, err)
+	}
+
+	for _ = range time.Tick(interval) {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Printf(log.ERROR, "cannot watch plugins %s: %s", file, err)
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+
+		log.Printf(log.INFO, "plugins %s changed, reloading", file)
+		if err := reloadPlugins(); err != nil {
+			log.Printf(log.ERROR, "error reloading plugins: %s", err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+func init() {
+	registerBackend("rfc2136", newRFC2136Backend)
+}
+
+// rfc2136Backend sends RFC 2136 updates with the serviceRecords of every
+// service to the primary of an existing zone.  Records do not expire, stale
+// ones are removed by reconciliation which finds them with a zone transfer
+type rfc2136Backend struct {
+	server string
+	zone   string
+
+	keyName   string
+	algorithm string
+	secret    map[string]string
+
+	sync.Mutex
+	services map[string]*msg.Service
+}
+
+func newRFC2136Backend() (Backend, error) {
+	return newRFC2136Client(params.RFC2136Server, params.Domain, params.TSIGKey, params.TSIGAlgorithm)
+}
+
+// newRFC2136Client creates a backend updating zone on server, key is the
+// TSIG key as name:base64 secret and may be empty to send unsigned updates
+func newRFC2136Client(server, zone, key, algorithm string) (*rfc2136Backend, error) {
+	b := &rfc2136Backend{
+		server:    server,
+		zone:      dns.Fqdn(strings.ToLower(zone)),
+		algorithm: dns.Fqdn(algorithm),
+		services:  make(map[string]*msg.Service),
+	}
+
+	if key != "" {
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("TSIG key must be name:secret")
+		}
+		b.keyName = dns.Fqdn(strings.ToLower(parts[0]))
+		b.secret = map[string]string{b.keyName: parts[1]}
+	}
+	return b, nil
+}
+
+// Add adds the records of service, adding records that exist is a no-op
+// in RFC 2136 so there are no conflicts
+func (b *rfc2136Backend) Add(uuid string, service *msg.Service) error {
+	m := b.update()
+	m.Insert(serviceRecords(b.zone, uuid, service))
+	if err := b.exchange(m); err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.services[uuid] = service
+	b.Unlock()
+	return nil
+}
+
+// Delete removes exactly the records Add sent for uuid.  Records another
+// service still has, such as the A record of a container recreated under
+// the same name and address, are kept
+func (b *rfc2136Backend) Delete(uuid string) error {
+	b.Lock()
+	service, exists := b.services[uuid]
+	b.Unlock()
+
+	if !exists {
+		// added before a restart
+		service, exists = registrations.service(uuid)
+	}
+	if !exists {
+		services, err := b.List()
+		if err != nil {
+			return err
+		}
+		for _, s := range services {
+			if s.UUID == uuid {
+				service, exists = s, true
+			}
+		}
+		if !exists {
+			return client.ErrServiceNotFound
+		}
+	}
+
+	b.Lock()
+	kept := make(map[string]struct{})
+	for other, s := range b.services {
+		if other == uuid {
+			continue
+		}
+		for _, rr := range serviceRecords(b.zone, other, s) {
+			kept[rr.String()] = struct{}{}
+		}
+	}
+	b.Unlock()
+
+	var records []dns.RR
+	for _, rr := range serviceRecords(b.zone, uuid, service) {
+		if _, exists := kept[rr.String()]; !exists {
+			records = append(records, rr)
+		}
+	}
+
+	m := b.update()
+	m.Remove(records)
+	if err := b.exchange(m); err != nil {
+		return err
+	}
+
+	b.Lock()
+	delete(b.services, uuid)
+	b.Unlock()
+	return nil
+}
+
+// Update does nothing, the records have no lifetime to refresh
+func (b *rfc2136Backend) Update(uuid string, ttl uint32) error {
+	return nil
+}
+
+// List transfers the zone and returns the services described by the TXT
+// records skydock added.  When the server refuses the transfer it returns
+// the services skydock registered instead, so reconciliation still works
+// from the registration table and -state
+func (b *rfc2136Backend) List() ([]*msg.Service, error) {
+	services, err := b.transfer()
+	if err != nil {
+		log.Printf(log.WARN, "zone transfer of %s from %s failed, listing the registered services instead: %s", b.zone, b.server, err)
+		return registrations.services(), nil
+	}
+	return services, nil
+}
+
+func (b *rfc2136Backend) transfer() ([]*msg.Service, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(b.zone)
+	b.sign(m)
+
+	t := &dns.Transfer{TsigSecret: b.secret}
+	envelopes, err := t.In(m, b.server)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*msg.Service
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		for _, rr := range envelope.RR {
+			if txt, ok := rr.(*dns.TXT); ok {
+				if service := parseMarker(txt.Txt); service != nil {
+					out = append(out, service)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func (b *rfc2136Backend) Close() error {
+	return nil
+}
+
+func (b *rfc2136Backend) update() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate(b.zone)
+	return m
+}
+
+func (b *rfc2136Backend) sign(m *dns.Msg) {
+	if b.keyName != "" {
+		m.SetTsig(b.keyName, b.algorithm, 300, time.Now().Unix())
+	}
+}
+
+func (b *rfc2136Backend) exchange(m *dns.Msg) error {
+	b.sign(m)
+
+	c := &dns.Client{Net: "tcp", TsigSecret: b.secret, Timeout: 5 * time.Second}
+	r, _, err := c.Exchange(m, b.server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of %s refused by %s: %s", b.zone, b.server, dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/heap"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/olitvin/skydock/slog"
+)
+
+const (
+	// refreshes fire between (1 - refreshJitter) and 1 times the
+	// interval so they do not all hit skydns at the same moment
+	refreshJitter = 0.2
+
+	minRefreshBackoff = time.Second
+)
+
+// refreshEntry is a service whose TTL is refreshed by the scheduler
+type refreshEntry struct {
+	UUID     string
+	Next     time.Time
+	Failures int
+
+	index int
+}
+
+// refreshQueue is a heap of entries ordered by their next refresh
+type refreshQueue []*refreshEntry
+
+func (q refreshQueue) Len() int           { return len(q) }
+func (q refreshQueue) Less(i, j int) bool { return q[i].Next.Before(q[j].Next) }
+
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *refreshQueue) Push(x interface{}) {
+	entry := x.(*refreshEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// refreshScheduler owns the TTL refreshes of every registered service.  A
+// single goroutine sleeps until the earliest refresh is due instead of
+// running a ticker per container
+type refreshScheduler struct {
+	sync.Mutex
+
+	interval time.Duration
+	refresh  func(uuid string) error
+	entries  map[string]*refreshEntry
+	queue    refreshQueue
+	wake     chan struct{}
+}
+
+func newRefreshScheduler(refresh func(uuid string) error) *refreshScheduler {
+	return &refreshScheduler{
+		refresh: refresh,
+		entries: make(map[string]*refreshEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// schedule starts refreshing uuid, it does nothing if uuid
+// is already scheduled
+func (s *refreshScheduler) schedule(uuid string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.entries[uuid]; exists {
+		return
+	}
+	entry := &refreshEntry{UUID: uuid, Next: time.Now().Add(s.jittered(s.interval))}
+	s.entries[uuid] = entry
+	heap.Push(&s.queue, entry)
+	s.notify()
+}
+
+// cancel stops refreshing uuid
+func (s *refreshScheduler) cancel(uuid string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if entry, exists := s.entries[uuid]; exists {
+		delete(s.entries, uuid)
+		if entry.index >= 0 {
+			heap.Remove(&s.queue, entry.index)
+		}
+		s.notify()
+	}
+}
+
+// scheduled returns a copy of the scheduled entries ordered by next refresh
+func (s *refreshScheduler) scheduled() []refreshEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	out := make([]refreshEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		out = append(out, *entry)
+	}
+	sort.Sort(byNextRefresh(out))
+	return out
+}
+
+// run refreshes entries as they become due, it never returns
+func (s *refreshScheduler) run() {
+	for {
+		s.Lock()
+		wait := time.Hour
+		if len(s.queue) > 0 {
+			wait = s.queue[0].Next.Sub(time.Now())
+		}
+		s.Unlock()
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+			}
+			timer.Stop()
+		}
+
+		for _, entry := range s.due() {
+			s.refreshEntry(entry)
+		}
+	}
+}
+
+// due pops every entry whose refresh time has passed
+func (s *refreshScheduler) due() []*refreshEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		now = time.Now()
+		out []*refreshEntry
+	)
+	for len(s.queue) > 0 && !s.queue[0].Next.After(now) {
+		out = append(out, heap.Pop(&s.queue).(*refreshEntry))
+	}
+	return out
+}
+
+func (s *refreshScheduler) refreshEntry(entry *refreshEntry) {
+	// don't fill logs if we have a low interval
+	if s.interval >= 30*time.Second {
+		log.Printf(log.INFO, "updating ttl for %s", entry.UUID)
+	}
+	err := s.refresh(entry.UUID)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if current, exists := s.entries[entry.UUID]; !exists || current != entry {
+		// cancelled while the refresh was running
+		return
+	}
+
+	next := s.interval
+	if err != nil {
+		entry.Failures++
+		next = minRefreshBackoff << uint(entry.Failures-1)
+		if next > s.interval || next <= 0 {
+			next = s.interval
+		}
+		log.Printf(log.ERROR, "failed to update ttl for %s (%d failures), retrying in %s: %s", entry.UUID, entry.Failures, next, err)
+	} else {
+		entry.Failures = 0
+	}
+
+	entry.Next = time.Now().Add(s.jittered(next))
+	heap.Push(&s.queue, entry)
+}
+
+func (s *refreshScheduler) jittered(d time.Duration) time.Duration {
+	return d - time.Duration(rand.Float64()*refreshJitter*float64(d))
+}
+
+// notify wakes the run loop so it recalculates its deadline
+func (s *refreshScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+type byNextRefresh []refreshEntry
+
+func (b byNextRefresh) Len() int           { return len(b) }
+func (b byNextRefresh) Less(i, j int) bool { return b[i].Next.Before(b[j].Next) }
+func (b byNextRefresh) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -1,13 +1,49 @@
 package main
 
 import (
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/client"
 	"github.com/skynetservices/skydns1/msg"
 )
 
-// Interface to allow mocking of the
-// skydns client
-type Skydns interface {
-	Add(uuid string, service *msg.Service) error
-	Delete(uuid string) error
-	Update(uuid string, ttl uint32) error
+func init() {
+	registerBackend("skydns", newSkydnsBackend)
+}
+
+// skydnsClient adapts the skydns1 client to the Backend interface
+type skydnsClient struct {
+	*client.Client
+}
+
+// newSkydnsBackend connects to skydns at -skydns, or to the skydns
+// container given with -name
+func newSkydnsBackend() (Backend, error) {
+	if params.SkydnsContainerName != "" {
+		log.Printf(log.INFO, "fetch skydns container: %s", params.SkydnsContainerName)
+		container, err := dockerClient.FetchContainer(params.SkydnsContainerName, "")
+		if err != nil {
+			log.Printf(log.FATAL, "error retrieving skydns container '%s': %s", params.SkydnsContainerName, err)
+			return nil, err
+		}
+
+		params.SkydnsURL = "http://" + container.NetworkSettings.IpAddress + ":5380"
+	}
+	return newSkydnsClient(params.SkydnsURL, params.Secret, params.Domain)
+}
+
+func newSkydnsClient(url, secret, domain string) (Backend, error) {
+	c, err := client.NewClient(url, secret, domain, "skydns")
+	if err != nil {
+		return nil, err
+	}
+	return &skydnsClient{c}, nil
+}
+
+func (c *skydnsClient) List() ([]*msg.Service, error) {
+	return c.GetAllServices()
+}
+
+// Close does nothing, the skydns client keeps no connections open
+func (c *skydnsClient) Close() error {
+	return nil
 }
@@ -1,9 +1,32 @@
 package utils
 
 import (
+	"strconv"
 	"strings"
 )
 
+// wellKnownPorts names common services for SRV records
+var wellKnownPorts = map[string]string{
+	"21/tcp":    "ftp",
+	"22/tcp":    "ssh",
+	"25/tcp":    "smtp",
+	"53/tcp":    "domain",
+	"53/udp":    "domain",
+	"80/tcp":    "http",
+	"110/tcp":   "pop3",
+	"143/tcp":   "imap",
+	"389/tcp":   "ldap",
+	"443/tcp":   "https",
+	"3306/tcp":  "mysql",
+	"5432/tcp":  "postgresql",
+	"5672/tcp":  "amqp",
+	"6379/tcp":  "redis",
+	"8080/tcp":  "http-alt",
+	"9200/tcp":  "elasticsearch",
+	"11211/tcp": "memcache",
+	"27017/tcp": "mongodb",
+}
+
 func Truncate(name string) string {
 	if len(name) > 10 {
 		return name[:10]
@@ -49,3 +72,12 @@ func CleanImageName(name string) string {
 	}
 	return CleanImageName(parts[1])
 }
+
+// PortName returns the well known service name of a port and protocol
+// or the port number when it has none
+func PortName(port int, protocol string) string {
+	if name, exists := wellKnownPorts[strconv.Itoa(port)+"/"+protocol]; exists {
+		return name
+	}
+	return strconv.Itoa(port)
+}
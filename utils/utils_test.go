@@ -143,4 +143,16 @@ func TestSplitURIHttp(t *testing.T) {
 	if actual_path != expected_path {
 		t.Fatalf("Expected %s got %s", expected_path, actual_path)
 	}
-}
\ No newline at end of file
+}
+
+func TestPortNameWellKnown(t *testing.T) {
+	if actual := PortName(80, "tcp"); actual != "http" {
+		t.Fatalf("Expected http got %s", actual)
+	}
+}
+
+func TestPortNameUnknown(t *testing.T) {
+	if actual := PortName(8125, "udp"); actual != "8125" {
+		t.Fatalf("Expected 8125 got %s", actual)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	log "github.com/olitvin/skydock/slog"
+	"github.com/skynetservices/skydns1/client"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+func init() {
+	registerBackend("zone", newZoneBackend)
+}
+
+// zoneBackend renders the serviceRecords of every service into an RFC 1035
+// zone file for the domain.  The file is rewritten with a new SOA serial on
+// every change and -zonereload is run afterwards so the nameserver loads it
+type zoneBackend struct {
+	path   string
+	zone   string
+	ns     string
+	reload string
+
+	sync.Mutex
+	serial   uint32
+	services map[string]*msg.Service
+}
+
+func newZoneBackend() (Backend, error) {
+	return newZoneFile(params.ZoneFile, params.Domain, params.ZoneNS, params.ZoneReload)
+}
+
+// newZoneFile creates a backend writing path, the serial and services
+// of an existing file are kept
+func newZoneFile(path, zone, ns, reload string) (*zoneBackend, error) {
+	b := &zoneBackend{
+		path:     path,
+		zone:     dns.Fqdn(strings.ToLower(zone)),
+		ns:       dns.Fqdn(ns),
+		reload:   reload,
+		services: make(map[string]*msg.Service),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	parser := dns.NewZoneParser(f, b.zone, path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			b.serial = rr.Serial
+		case *dns.TXT:
+			if service := parseMarker(rr.Txt); service != nil {
+				b.services[service.UUID] = service
+			}
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read zone file %s: %s", path, err)
+	}
+	return b, nil
+}
+
+func (b *zoneBackend) Add(uuid string, service *msg.Service) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; exists {
+		return client.ErrConflictingUUID
+	}
+	b.services[uuid] = service
+	return b.write()
+}
+
+func (b *zoneBackend) Delete(uuid string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; !exists {
+		return client.ErrServiceNotFound
+	}
+	delete(b.services, uuid)
+	return b.write()
+}
+
+// Update does nothing, records stay in the zone until they are deleted
+func (b *zoneBackend) Update(uuid string, ttl uint32) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, exists := b.services[uuid]; !exists {
+		return client.ErrServiceNotFound
+	}
+	return nil
+}
+
+func (b *zoneBackend) List() ([]*msg.Service, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	out := make([]*msg.Service, 0, len(b.services))
+	for uuid, service := range b.services {
+		listed := *service
+		listed.UUID = uuid
+		out = append(out, &listed)
+	}
+	return out, nil
+}
+
+func (b *zoneBackend) Close() error {
+	return nil
+}
+
+// write renders the zone with the next serial, replaces the file and
+// runs -zonereload
+func (b *zoneBackend) write() error {
+	b.serial++
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "; generated by skydock, changes will be overwritten\n$ORIGIN %s\n$TTL %d\n", b.zone, params.TTL)
+	for _, rr := range b.render() {
+		fmt.Fprintln(&buf, rr.String())
+	}
+
+	if err := writeFileAtomic(b.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	if b.reload != "" {
+		if out, err := exec.Command("sh", "-c", b.reload).CombinedOutput(); err != nil {
+			log.Printf(log.ERROR, "error running %q: %s: %s", b.reload, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// render returns the SOA and NS records followed by the records of every
+// service sorted by name and type
+func (b *zoneBackend) render() []dns.RR {
+	ttl := uint32(params.TTL)
+	out := []dns.RR{
+		&dns.SOA{
+			Hdr:     dns.RR_Header{Name: b.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:      b.ns,
+			Mbox:    "hostmaster." + b.zone,
+			Serial:  b.serial,
+			Refresh: 28800,
+			Retry:   7200,
+			Expire:  604800,
+			Minttl:  ttl,
+		},
+		&dns.NS{Hdr: dns.RR_Header{Name: b.zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl}, Ns: b.ns},
+	}
+
+	var (
+		records []dns.RR
+		seen    = make(map[string]struct{})
+	)
+	for uuid, service := range b.services {
+		for _, rr := range serviceRecords(b.zone, uuid, service) {
+			// instances of a service share the A records of its name
+			if _, exists := seen[rr.String()]; exists {
+				continue
+			}
+			seen[rr.String()] = struct{}{}
+			records = append(records, rr)
+		}
+	}
+	sort.Sort(byOwner(records))
+	return append(out, records...)
+}
+
+type byOwner []dns.RR
+
+func (b byOwner) Len() int      { return len(b) }
+func (b byOwner) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byOwner) Less(i, j int) bool {
+	if b[i].Header().Name != b[j].Header().Name {
+		return b[i].Header().Name < b[j].Header().Name
+	}
+	if b[i].Header().Rrtype != b[j].Header().Rrtype {
+		return b[i].Header().Rrtype < b[j].Header().Rrtype
+	}
+	return b[i].String() < b[j].String()
+}